@@ -0,0 +1,268 @@
+// Package fakehe is a fake dns.he.net for the tests, so that the client can
+// be exercised against the HTML it expects without reaching HE
+package fakehe
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Username = "user@example.com"
+	Password = "secret"
+	// base32 of "12345678901234567890", the RFC 6238 test seed
+	TotpSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+)
+
+const loginPage = `<html><body><form name="login" method="post">
+<input type="text" name="email"/><input type="password" name="pass"/>
+<input type="submit" name="submit" value="Login!"/></form></body></html>`
+
+const totpPage = `<html><body><form name="tfa" method="post">
+<input type="text" name="tfacode"/><input type="submit" name="submit" value="Submit"/>
+</form></body></html>`
+
+const failedLoginPage = `<html><body><div id="dns_err">Incorrect</div></body></html>`
+
+const zoneRow = `<tr><td></td><td><img onclick="javascript:document.location.href='?hosted_dns_zoneid=%d&menu=edit_zone&hosted_dns_editzone'"/></td><td><span>%s</span></td></tr>`
+
+// RecordRow is a row of the records table of a zone page: its class, the
+// record ID, name, type (twice), TTL, priority and content
+const RecordRow = `<tr class="%s"><td class="hidden">1234</td><td class="hidden">%s</td><td class="dns_view">%s</td>
+<td><span class="rrlabel" data="%s">%s</span></td><td>%s</td><td>%s</td><td data="%s">-</td><td class="hidden">0</td><td></td><td></td></tr>`
+
+// Record is a record as HE stores it, with the priority of MX and SRV records apart
+type Record struct {
+	Id       int
+	Name     string
+	Type     string
+	Ttl      string
+	Priority string
+	Content  string
+}
+
+// HE mimics, for the tests, the login flow of dns.he.net, optionally
+// with the 2FA step, the zone list with its add and delete forms, and the
+// zone pages with the record edit and delete forms. Logging out ends the
+// session of the cookie, like HE does
+type HE struct {
+	requireTotp bool
+	// session cookie -> login state ("password" or "done")
+	sessions map[string]string
+	// zone name -> zone ID
+	zones map[string]int
+	// zone ID -> records
+	records map[int][]*Record
+	nextId  int
+	mutex   sync.Mutex
+}
+
+func New(requireTotp bool) (*httptest.Server, *HE) {
+	he := &HE{
+		requireTotp: requireTotp,
+		sessions:    map[string]string{},
+		zones:       map[string]int{"foo.bar": 1234},
+		records:     map[int][]*Record{},
+		nextId:      2000,
+	}
+	return httptest.NewServer(he), he
+}
+
+// return a copy of the records of the zone
+func (he *HE) Records(zoneId int) []Record {
+	he.mutex.Lock()
+	defer he.mutex.Unlock()
+	records := []Record{}
+	for _, record := range he.records[zoneId] {
+		records = append(records, *record)
+	}
+	return records
+}
+
+// return the ID of the zone, 0 if it's not in the account
+func (he *HE) ZoneId(zone string) int {
+	he.mutex.Lock()
+	defer he.mutex.Unlock()
+	return he.zones[zone]
+}
+
+func (he *HE) zonesPage() string {
+	rows := []string{}
+	for zone, id := range he.zones {
+		rows = append(rows, fmt.Sprintf(zoneRow, id, zone))
+	}
+	return `<html><body><table id="domains_table"><tbody>` + strings.Join(rows, "\n") + `</tbody></table></body></html>`
+}
+
+// the zone page has the message given, if any, and the records of the zone
+func (he *HE) zonePage(zoneId int, message string) string {
+	rows := []string{}
+	for _, record := range he.records[zoneId] {
+		priority := record.Priority
+		if priority == "" {
+			priority = "-"
+		}
+		rows = append(rows, fmt.Sprintf(RecordRow, "dns_tr", strconv.Itoa(record.Id), record.Name, record.Type, record.Type,
+			record.Ttl, priority, html.EscapeString(record.Content)))
+	}
+	return fmt.Sprintf(`<html><body><div>%s</div><div id="dns_main_content"><h2>Managing zone: %s</h2><table>%s</table></div></body></html>`,
+		message, he.zoneName(zoneId), strings.Join(rows, "\n"))
+}
+
+func (he *HE) zoneName(zoneId int) string {
+	for zone, id := range he.zones {
+		if id == zoneId {
+			return zone
+		}
+	}
+	return ""
+}
+
+// handle the record edit and delete forms
+func (he *HE) editRecord(w http.ResponseWriter, form url.Values) {
+
+	zoneId, _ := strconv.Atoi(form.Get("hosted_dns_zoneid"))
+	recordId, _ := strconv.Atoi(form.Get("hosted_dns_recordid"))
+
+	if form.Get("hosted_dns_delrecord") == "1" {
+		records := []*Record{}
+		for _, record := range he.records[zoneId] {
+			if record.Id != recordId {
+				records = append(records, record)
+			}
+		}
+		he.records[zoneId] = records
+		fmt.Fprint(w, he.zonePage(zoneId, "Successfully removed record."))
+		return
+	}
+
+	record := &Record{
+		Id:       recordId,
+		Name:     form.Get("Name"),
+		Type:     form.Get("Type"),
+		Ttl:      form.Get("TTL"),
+		Priority: form.Get("Priority"),
+		Content:  form.Get("Content"),
+	}
+	if recordId == 0 {
+		record.Id = he.nextId
+		he.nextId++
+		he.records[zoneId] = append(he.records[zoneId], record)
+		fmt.Fprint(w, he.zonePage(zoneId, fmt.Sprintf("Successfully added new record to %s", he.zoneName(zoneId))))
+		return
+	}
+	for i, existing := range he.records[zoneId] {
+		if existing.Id == recordId {
+			he.records[zoneId][i] = record
+		}
+	}
+	fmt.Fprint(w, he.zonePage(zoneId, "Successfully updated record. "))
+}
+
+func (he *HE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	he.mutex.Lock()
+	defer he.mutex.Unlock()
+
+	cookie, err := r.Cookie("CGISESSID")
+	if err != nil {
+		cookie = &http.Cookie{Name: "CGISESSID", Value: fmt.Sprintf("session%d", len(he.sessions))}
+		http.SetCookie(w, cookie)
+		he.sessions[cookie.Value] = ""
+	}
+
+	if r.Method == http.MethodGet {
+		if r.URL.Query().Get("action") == "logout" {
+			delete(he.sessions, cookie.Value)
+		}
+		if he.sessions[cookie.Value] == "done" {
+			if zoneId, err := strconv.Atoi(r.URL.Query().Get("hosted_dns_zoneid")); err == nil {
+				fmt.Fprint(w, he.zonePage(zoneId, ""))
+				return
+			}
+			fmt.Fprint(w, he.zonesPage())
+			return
+		}
+		fmt.Fprint(w, loginPage)
+		return
+	}
+
+	r.ParseForm()
+	if r.URL.Path == "/index.cgi" {
+		if he.sessions[cookie.Value] != "done" {
+			fmt.Fprint(w, loginPage)
+			return
+		}
+		if r.PostForm.Get("hosted_dns_editzone") == "1" {
+			he.editRecord(w, r.PostForm)
+			return
+		}
+		if r.PostForm.Get("action") == "add_zone" {
+			he.zones[r.PostForm.Get("add_domain")] = he.nextId
+			he.nextId++
+		}
+		if r.PostForm.Get("remove_domain") == "1" {
+			for zone, id := range he.zones {
+				if fmt.Sprintf("%d", id) == r.PostForm.Get("delete_id") {
+					delete(he.zones, zone)
+				}
+			}
+		}
+		fmt.Fprint(w, "<html><body>ok</body></html>")
+		return
+	}
+
+	switch {
+	case r.PostForm.Get("email") != "":
+		if r.PostForm.Get("email") != Username || r.PostForm.Get("pass") != Password {
+			fmt.Fprint(w, failedLoginPage)
+			return
+		}
+		if he.requireTotp {
+			he.sessions[cookie.Value] = "password"
+			fmt.Fprint(w, totpPage)
+			return
+		}
+	case r.PostForm.Get("tfacode") != "":
+		if he.sessions[cookie.Value] != "password" {
+			fmt.Fprint(w, loginPage)
+			return
+		}
+		// like most servers, accept the previous code too
+		code := r.PostForm.Get("tfacode")
+		if code != totp(time.Now()) && code != totp(time.Now().Add(-30*time.Second)) {
+			fmt.Fprint(w, totpPage)
+			return
+		}
+	default:
+		fmt.Fprint(w, loginPage)
+		return
+	}
+
+	he.sessions[cookie.Value] = "done"
+	fmt.Fprint(w, he.zonesPage())
+}
+
+// the RFC 6238 code of the secret for the given time, computed here rather
+// than with the client's own code, so the tests check one against the other
+func totp(t time.Time) string {
+	key, _ := base32.StdEncoding.DecodeString(TotpSecret)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
@@ -7,8 +7,10 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/cli"
 	"github.com/waldner/external-dns-webhook-he/pkg/client"
 	"github.com/waldner/external-dns-webhook-he/pkg/config"
+	"github.com/waldner/external-dns-webhook-he/pkg/metrics"
 	"github.com/waldner/external-dns-webhook-he/pkg/provider"
 	"github.com/waldner/external-dns-webhook-he/pkg/webhook"
 )
@@ -42,6 +44,11 @@ func initLog() {
 }
 
 func main() {
+	if cli.HelpRequested(os.Args[1:]) {
+		cli.PrintUsage()
+		return
+	}
+
 	initLog()
 	log.WithFields(log.Fields{"version": version}).Info("Starting external-dns-webhook-he")
 
@@ -55,11 +62,19 @@ func main() {
 		log.Fatal(err)
 	}
 
-	provider, err := provider.NewProvider(client, domainFilter)
+	provider, err := provider.NewProvider(client, domainFilter, heConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// run a single command instead of the server
+	if len(os.Args) > 1 {
+		if err := cli.Run(provider, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	hook, err := webhook.NewWebhook(provider)
 	if err != nil {
 		log.Fatal(err)
@@ -67,13 +82,41 @@ func main() {
 
 	r := chi.NewRouter()
 
-	// healthcheck as middleware
+	// liveness check as middleware
 	r.Use(webhook.Health)
+	r.Use(webhook.Metrics)
+	r.Use(webhook.RequestId)
+
+	r.Get("/readyz", hook.Readyz)
 
 	r.Get("/", hook.Negotiate)
 	r.Get("/records", hook.Records)
 	r.Post("/adjustendpoints", hook.AdjustEndpoints)
 	r.Post("/records", hook.ApplyChanges)
 
+	r.Handle("/metrics", metrics.Handler())
+
+	// the admin endpoints are not for external-dns, so they are only
+	// served if enabled, and on their own listener (localhost by default)
+	if heConfig.AdminEnabled {
+		admin := chi.NewRouter()
+		admin.Use(webhook.Metrics)
+		admin.Use(webhook.RequestId)
+		admin.Use(webhook.AdminAuth(heConfig.AdminToken))
+
+		admin.Post("/cache/flush", hook.FlushCache)
+		admin.Get("/status", hook.Status(version))
+
+		// zone management
+		admin.Post("/zones", hook.AddZone)
+		admin.Delete("/zones/{zone}", hook.DeleteZone)
+		admin.Get("/export", hook.Export)
+
+		log.Infof("Serving the admin endpoints on %s", heConfig.AdminAddress)
+		go func() {
+			log.Fatal(http.ListenAndServe(heConfig.AdminAddress, admin))
+		}()
+	}
+
 	http.ListenAndServe(":3333", r)
 }
@@ -0,0 +1,167 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// nothing was sent to HE, eg deletion of a record that doesn't exist
+	OutcomeSkipped = "skipped"
+)
+
+// a record operation sent (or about to be sent) to HE
+type Entry struct {
+	Time time.Time `json:"time"`
+	// the ApplyChanges run the operation is part of
+	BatchId string `json:"batchId,omitempty"`
+	// the webhook (or command line) requests that caused it
+	RequestIds []string `json:"requestIds,omitempty"`
+	Action     string   `json:"action"`
+	Zone       string   `json:"zone"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Targets    []string `json:"targets"`
+	// for updates, the targets that have been replaced, if known
+	PreviousTargets []string `json:"previousTargets,omitempty"`
+	TTL             int64    `json:"ttl"`
+	RecordId        string   `json:"recordId,omitempty"`
+	Outcome         string   `json:"outcome"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// Logger appends entries to a JSON Lines file. When the file would grow beyond
+// maxSize bytes, it's renamed to <path>.1 (the older ones shift to <path>.2 and so
+// on, up to maxFiles) and a new one is started. A nil Logger discards everything
+type Logger struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mutex    sync.Mutex
+}
+
+// return a logger appending to the file at path, or nil if path is empty.
+// maxSize 0 disables rotation
+func NewLogger(path string, maxSize int64, maxFiles int) (*Logger, error) {
+
+	if path == "" {
+		return nil, nil
+	}
+
+	l := &Logger{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := l.open(); err != nil {
+		return nil, fmt.Errorf("NewLogger: %s", err)
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("open: cannot open audit log: %s", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("open: %s", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// shift the old files and start a new one
+func (l *Logger) rotate() error {
+
+	if err := l.file.Close(); err != nil {
+		log.Warnf("rotate: error closing audit log: %s", err)
+	}
+	l.file = nil
+
+	// the audit log is never just thrown away
+	maxFiles := max(l.maxFiles, 1)
+
+	os.Remove(rotatedPath(l.path, maxFiles))
+	for i := maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedPath(l.path, i), rotatedPath(l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotate: %s", err)
+		}
+	}
+	if err := os.Rename(l.path, rotatedPath(l.path, 1)); err != nil {
+		return fmt.Errorf("rotate: %s", err)
+	}
+	return l.open()
+}
+
+func rotatedPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// append the entry to the log. Failing to write the audit log doesn't stop
+// the operation, but is logged as an error
+func (l *Logger) Log(entry *Entry) {
+
+	if l == nil {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Log: cannot encode audit entry: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Errorf("Log: cannot rotate audit log: %s", err)
+		}
+	}
+	// if the rotation failed midway, keep writing to whatever is at path
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			log.Errorf("Log: %s", err)
+			return
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Errorf("Log: cannot write audit log: %s", err)
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,129 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testEntry(zone string, name string, t time.Time) *Entry {
+	return &Entry{
+		Time:    t,
+		BatchId: "batch1",
+		Action:  ActionCreate,
+		Zone:    zone,
+		Name:    name,
+		Type:    "A",
+		Targets: []string{"1.2.3.4"},
+		TTL:     300,
+		Outcome: OutcomeSuccess,
+	}
+}
+
+func TestRotation(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	// room for about two entries per file
+	logger, err := NewLogger(path, 400, 2)
+	if err != nil {
+		t.Fatalf("NewLogger should not have failed, but got: %s", err)
+	}
+	defer logger.Close()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		logger.Log(testEntry("foo.bar", "a.foo.bar", start.Add(time.Duration(i)*time.Minute)))
+	}
+
+	for _, file := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("%s should exist, but got: %s", file, err)
+		}
+		if info.Size() > 400 {
+			t.Errorf("%s is larger than the maximum size: %d", file, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("only 2 rotated files should be kept")
+	}
+
+	// what's left is still in order, and ends with the last entry
+	entries, err := Query(path, &Filter{})
+	if err != nil {
+		t.Fatalf("Query should not have failed, but got: %s", err)
+	}
+	if len(entries) == 0 || len(entries) >= 10 {
+		t.Fatalf("Query: expected some of the entries to be rotated away, got %d", len(entries))
+	}
+	for i := 1; i < len(entries); i++ {
+		if !entries[i].Time.After(entries[i-1].Time) {
+			t.Errorf("Query: entries out of order: %s after %s", entries[i].Time, entries[i-1].Time)
+		}
+	}
+	if last := entries[len(entries)-1].Time; !last.Equal(start.Add(9 * time.Minute)) {
+		t.Errorf("Query: got %s as last entry, wanted %s", last, start.Add(9*time.Minute))
+	}
+}
+
+func TestQuery(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	logger, err := NewLogger(path, 0, 1)
+	if err != nil {
+		t.Fatalf("NewLogger should not have failed, but got: %s", err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	logger.Log(testEntry("foo.bar", "a.foo.bar", start))
+	logger.Log(testEntry("foo.bar", "b.foo.bar", start.Add(time.Hour)))
+	logger.Log(testEntry("foo.baz", "a.foo.baz", start.Add(2*time.Hour)))
+	logger.Close()
+
+	// garbage is skipped
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	file.WriteString("not json\n")
+	file.Close()
+
+	for _, test := range []struct {
+		name     string
+		filter   *Filter
+		expected []string
+	}{
+		{"all", &Filter{}, []string{"a.foo.bar", "b.foo.bar", "a.foo.baz"}},
+		{"zone", &Filter{Zone: "foo.bar"}, []string{"a.foo.bar", "b.foo.bar"}},
+		{"name", &Filter{Name: "b.foo.bar"}, []string{"b.foo.bar"}},
+		{"since", &Filter{Since: start.Add(30 * time.Minute)}, []string{"b.foo.bar", "a.foo.baz"}},
+		{"until", &Filter{Until: start.Add(30 * time.Minute)}, []string{"a.foo.bar"}},
+		{"batch", &Filter{BatchId: "other"}, []string{}},
+	} {
+		entries, err := Query(path, test.filter)
+		if err != nil {
+			t.Fatalf("%s: Query should not have failed, but got: %s", test.name, err)
+		}
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		if len(names) != len(test.expected) {
+			t.Errorf("%s: got %v, wanted %v", test.name, names, test.expected)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("%s: got %v, wanted %v", test.name, names, test.expected)
+				break
+			}
+		}
+	}
+
+	if _, err := Query(filepath.Join(t.TempDir(), "missing.jsonl"), &Filter{}); err == nil {
+		t.Errorf("Query should have failed for a missing log")
+	}
+
+	// a nil logger is a no-op
+	var nilLogger *Logger
+	nilLogger.Log(testEntry("foo.bar", "a.foo.bar", start))
+}
@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// which entries to return, empty fields match everything
+type Filter struct {
+	Zone string
+	// exact match on the record name
+	Name    string
+	BatchId string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f *Filter) match(entry *Entry) bool {
+	if f.Zone != "" && entry.Zone != f.Zone {
+		return false
+	}
+	if f.Name != "" && entry.Name != f.Name {
+		return false
+	}
+	if f.BatchId != "" && entry.BatchId != f.BatchId {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && entry.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// return the entries matching the filter, from the log at path and its
+// rotated files, oldest first. Lines that cannot be decoded are skipped
+func Query(path string, filter *Filter) ([]*Entry, error) {
+
+	files, err := logFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("Query: %s", err)
+	}
+
+	entries := []*Entry{}
+	for _, file := range files {
+		fileEntries, err := readFile(file, filter)
+		if err != nil {
+			return nil, fmt.Errorf("Query: %s", err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return entries, nil
+}
+
+// the rotated files, oldest first, then the current one
+func logFiles(path string) ([]string, error) {
+
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("logFiles: %s", err)
+	}
+
+	rotated := map[string]int{}
+	files := []string{}
+	for _, match := range matches {
+		i, err := strconv.Atoi(strings.TrimPrefix(match, path+"."))
+		if err != nil {
+			continue
+		}
+		rotated[match] = i
+		files = append(files, match)
+	}
+	sort.Slice(files, func(a, b int) bool { return rotated[files[a]] > rotated[files[b]] })
+
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	} else if len(files) == 0 {
+		return nil, fmt.Errorf("logFiles: %s", err)
+	}
+	return files, nil
+}
+
+func readFile(path string, filter *Filter) ([]*Entry, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("readFile: %s", err)
+	}
+	defer file.Close()
+
+	entries := []*Entry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		entry := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			log.Warnf("readFile: %s:%d: skipping invalid entry: %s", path, line, err)
+			continue
+		}
+		if filter.match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("readFile: %s: %s", path, err)
+	}
+	return entries, nil
+}
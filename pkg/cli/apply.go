@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func runApply(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	flags := flag.NewFlagSet("apply", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	path := flags.String("f", "", "")
+	yes := flags.Bool("yes", false, "")
+	dryRun := flags.Bool("dry-run", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 || *path == "" {
+		return fmt.Errorf("runApply: %w", errUsage)
+	}
+
+	changes, err := readChanges(*path)
+	if err != nil {
+		return fmt.Errorf("runApply: %s", err)
+	}
+
+	fmt.Println("Changes to apply:")
+	printChanges(os.Stdout, changes)
+
+	if *dryRun || isEmpty(changes) {
+		return nil
+	}
+	if !confirm("Apply these changes?", *yes) {
+		fmt.Println("Nothing done")
+		return nil
+	}
+
+	if err := provider.ApplyChanges(ctx, changes); err != nil {
+		return fmt.Errorf("runApply: %s", err)
+	}
+	fmt.Println("Changes applied")
+	return nil
+}
+
+// read a plan.Changes, as external-dns sends it to the webhook, from a file or "-" for stdin
+func readChanges(path string) (*plan.Changes, error) {
+
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("readChanges: %s", err)
+	}
+
+	changes := &plan.Changes{}
+	if err := json.Unmarshal(data, changes); err != nil {
+		return nil, fmt.Errorf("readChanges: %s: %s", path, err)
+	}
+	if len(changes.UpdateOld) != len(changes.UpdateNew) {
+		return nil, fmt.Errorf("readChanges: %s: UpdateOld and UpdateNew must have the same number of records", path)
+	}
+	for _, records := range [][]*endpoint.Endpoint{changes.Create, changes.UpdateOld, changes.UpdateNew, changes.Delete} {
+		for _, record := range records {
+			if record == nil || record.DNSName == "" || record.RecordType == "" || len(record.Targets) == 0 {
+				return nil, fmt.Errorf("readChanges: %s: every record needs dnsName, recordType and targets", path)
+			}
+		}
+	}
+	return changes, nil
+}
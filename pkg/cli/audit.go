@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/audit"
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+)
+
+func runAudit(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	zone := flags.String("zone", "", "")
+	name := flags.String("name", "", "")
+	batch := flags.String("batch", "", "")
+	since := flags.String("since", "", "")
+	until := flags.String("until", "", "")
+	jsonOutput := flags.Bool("json", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return fmt.Errorf("runAudit: %w", errUsage)
+	}
+
+	filter := &audit.Filter{Zone: *zone, Name: *name, BatchId: *batch}
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		return fmt.Errorf("runAudit: --since: %s", err)
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		return fmt.Errorf("runAudit: --until: %s", err)
+	}
+
+	entries, err := provider.AuditEntries(filter)
+	if err != nil {
+		return fmt.Errorf("runAudit: %s", err)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return fmt.Errorf("runAudit: %s", err)
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tBATCH\tACTION\tZONE\tNAME\tTYPE\tTARGETS\tTTL\tRECORD ID\tOUTCOME")
+	for _, entry := range entries {
+		targets := strings.Join(entry.Targets, ",")
+		if len(entry.PreviousTargets) > 0 {
+			targets = strings.Join(entry.PreviousTargets, ",") + " -> " + targets
+		}
+		outcome := entry.Outcome
+		if entry.Error != "" {
+			outcome += ": " + entry.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", entry.Time.Local().Format(time.RFC3339), entry.BatchId,
+			entry.Action, entry.Zone, entry.Name, entry.Type, targets, entry.TTL, entry.RecordId, outcome)
+	}
+	return w.Flush()
+}
+
+// accept an RFC 3339 time, a date, or a duration meaning "that long ago"
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parseTime: '%s' is not a time (eg 2024-01-31T10:00:00Z), a date (eg 2024-01-31) or a duration (eg 24h)", value)
+	}
+	return t, nil
+}
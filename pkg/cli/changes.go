@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func isEmpty(changes *plan.Changes) bool {
+	return len(changes.Create) == 0 && len(changes.UpdateOld) == 0 && len(changes.UpdateNew) == 0 && len(changes.Delete) == 0
+}
+
+func formatRecord(ep *endpoint.Endpoint) string {
+	return fmt.Sprintf("%s %s %s", ep.DNSName, ep.RecordType, strings.Join(ep.Targets, ","))
+}
+
+// print the changes in a readable form, one line per record
+func printChanges(w io.Writer, changes *plan.Changes) {
+
+	if isEmpty(changes) {
+		fmt.Fprintln(w, "No changes")
+		return
+	}
+	for _, ep := range changes.Delete {
+		fmt.Fprintf(w, "  - delete  %s\n", formatRecord(ep))
+	}
+	for i := range changes.UpdateOld {
+		if i < len(changes.UpdateNew) {
+			fmt.Fprintf(w, "  ~ update  %s %s %s -> %s\n", changes.UpdateOld[i].DNSName, changes.UpdateOld[i].RecordType,
+				strings.Join(changes.UpdateOld[i].Targets, ","), strings.Join(changes.UpdateNew[i].Targets, ","))
+		}
+	}
+	for _, ep := range changes.Create {
+		fmt.Fprintf(w, "  + create  %s\n", formatRecord(ep))
+	}
+	fmt.Fprintf(w, "%d to delete, %d to update, %d to create\n", len(changes.Delete), len(changes.UpdateOld), len(changes.Create))
+}
+
+// ask for confirmation on the terminal, unless already given
+func confirm(question string, yes bool) bool {
+	if yes {
+		return true
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,91 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+type configCheck struct {
+	Config       map[string]string      `json:"config"`
+	DomainFilter *endpoint.DomainFilter `json:"domainFilter"`
+	Zones        []string               `json:"zones"`
+	Ok           bool                   `json:"ok"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// the configuration has already been validated when reading it, so
+// what's left to check is that it works with HE
+func runCheckConfig(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	jsonOutput := flags.Bool("json", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return fmt.Errorf("runCheckConfig: %w", errUsage)
+	}
+
+	status := provider.Status()
+	check := &configCheck{Config: status.Config, DomainFilter: status.DomainFilter, Zones: []string{}}
+
+	zones, err := provider.ManagedZones(ctx)
+	if err == nil && len(zones) == 0 {
+		err = fmt.Errorf("no zone in the account matches the domain filter")
+	}
+	if zones != nil {
+		check.Zones = zones
+	}
+	check.Ok = err == nil
+	if err != nil {
+		check.Error = err.Error()
+	}
+
+	if *jsonOutput {
+		if err := writeJson(check); err != nil {
+			return fmt.Errorf("runCheckConfig: %s", err)
+		}
+	} else {
+		printConfigCheck(check)
+	}
+
+	if err != nil {
+		return fmt.Errorf("runCheckConfig: %s", err)
+	}
+	return nil
+}
+
+func printConfigCheck(check *configCheck) {
+
+	keys := []string{}
+	for key := range check.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Configuration:")
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s\t%s\n", key, check.Config[key])
+	}
+	w.Flush()
+
+	filter, _ := json.Marshal(check.DomainFilter)
+	fmt.Printf("Domain filter: %s\n", filter)
+	fmt.Printf("Managed zones: %d\n", len(check.Zones))
+	for _, zone := range check.Zones {
+		fmt.Printf("  %s\n", zone)
+	}
+	if check.Ok {
+		fmt.Println("Login to HE: ok")
+	} else {
+		fmt.Printf("Check failed: %s\n", check.Error)
+	}
+}
@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+)
+
+// returned by commands when their arguments are wrong
+var errUsage = errors.New("wrong arguments")
+
+// a subcommand of the webhook binary, eg "zone add example.com"
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(ctx context.Context, provider *provider.Provider, args []string) error
+}
+
+var commands = []*command{
+	{
+		name:        "zones",
+		usage:       "zones [--json]",
+		description: "list the zones in the HE account that match the domain filter",
+		run:         runZones,
+	},
+	{
+		name:        "records",
+		usage:       "records [--json] <zone>",
+		description: "show the current records of a zone, read from HE",
+		run:         runRecords,
+	},
+	{
+		name:        "apply",
+		usage:       "apply [--dry-run] [--yes] -f <changes.json>",
+		description: "apply changes in the format external-dns sends to the webhook (Create, UpdateOld, UpdateNew, Delete), - reads them from stdin",
+		run:         runApply,
+	},
+	{
+		name:        "sync",
+		usage:       "sync [--dry-run] [--yes] -f <records.yaml>",
+		description: "bring a zone to the records in a YAML or JSON file, deleting others only if they match its prune selector",
+		run:         runSync,
+	},
+	{
+		name:        "check-config",
+		usage:       "check-config [--json]",
+		description: "show the configuration (secrets redacted), then log in to HE and list the zones that match the domain filter",
+		run:         runCheckConfig,
+	},
+	{
+		name:        "zone",
+		usage:       "zone add|delete <zone>",
+		description: "create a zone, or delete it and all its records (needs WEBHOOK_HE_ALLOW_ZONE_DELETION=true)",
+		run:         runZone,
+	},
+	{
+		name:        "audit",
+		usage:       "audit [--zone Z] [--name N] [--batch ID] [--since T] [--until T] [--json]",
+		description: "show the record changes in the audit log; times can be RFC 3339, dates or durations (eg 24h ago)",
+		run:         runAudit,
+	},
+	{
+		name:        "undo",
+		usage:       "undo [--dry-run] [--yes] <batch ID>|--last",
+		description: "revert the record changes of a batch in the audit log, after showing them and asking for confirmation",
+		run:         runUndo,
+	},
+	{
+		name:        "restore",
+		usage:       "restore [--dry-run] [--yes] <zone> [snapshot]|--list <zone>",
+		description: "bring a zone back to a snapshot (the latest by default), after showing the changes and asking for confirmation",
+		run:         runRestore,
+	},
+	{
+		name:        "export",
+		usage:       "export [--format bind|json|csv] [--output F] [zone]",
+		description: "write the records of a zone, or of all the managed zones, as a BIND zone file, external-dns endpoints or CSV",
+		run:         runExport,
+	},
+	{
+		name:        "import",
+		usage:       "import [--dry-run] [--yes] [--delete] [--origin O] <zone> <file>",
+		description: "create the records of a BIND zone file that are missing from the zone (with --delete, also delete those not in the file)",
+		run:         runImport,
+	},
+}
+
+// run the subcommand in args[0], with the rest of args as its arguments
+func Run(provider *provider.Provider, args []string) error {
+
+	if len(args) == 0 || HelpRequested(args) {
+		PrintUsage()
+		return nil
+	}
+
+	// stop cleanly on ctrl-c
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// changes made from the command line are recognizable in the audit log
+	ctx = common.WithRequestId(ctx, "cli-"+common.NewId())
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			err := cmd.run(ctx, provider, args[1:])
+			if errors.Is(err, errUsage) {
+				return fmt.Errorf("Run: %s, usage: %s", err, cmd.usage)
+			}
+			return err
+		}
+	}
+
+	PrintUsage()
+	return fmt.Errorf("Run: unknown command '%s'", args[0])
+}
+
+// whether the arguments only ask for the usage, which doesn't need any configuration
+func HelpRequested(args []string) bool {
+	return len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "--help")
+}
+
+func PrintUsage() {
+	usage := []string{"Usage: external-dns-webhook-he [command]", "", "Without a command, the webhook server is started. Commands:"}
+	for _, cmd := range commands {
+		usage = append(usage, fmt.Sprintf("  %-40s %s", cmd.usage, cmd.description))
+	}
+	fmt.Fprintln(os.Stderr, strings.Join(usage, "\n"))
+}
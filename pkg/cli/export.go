@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+	"github.com/waldner/external-dns-webhook-he/pkg/zonefile"
+)
+
+func runExport(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	format := flags.String("format", zonefile.FormatBind, "")
+	output := flags.String("output", "", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return fmt.Errorf("runExport: %w", errUsage)
+	}
+	if !zonefile.IsFormat(*format) {
+		return fmt.Errorf("runExport: %w: '%s'", zonefile.ErrUnknownFormat, *format)
+	}
+
+	zones, err := provider.ExportZones(ctx, flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("runExport: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := zonefile.Export(&buf, *format, zones); err != nil {
+		return fmt.Errorf("runExport: %s", err)
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+	} else {
+		err = os.WriteFile(*output, buf.Bytes(), 0o600)
+	}
+	if err != nil {
+		return fmt.Errorf("runExport: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+	"github.com/waldner/external-dns-webhook-he/pkg/zonefile"
+)
+
+func runImport(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	prune := flags.Bool("delete", false, "")
+	yes := flags.Bool("yes", false, "")
+	dryRun := flags.Bool("dry-run", false, "")
+	origin := flags.String("origin", "", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return fmt.Errorf("runImport: %w", errUsage)
+	}
+	zone, path := flags.Arg(0), flags.Arg(1)
+	if *origin == "" {
+		*origin = zone
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("runImport: %s", err)
+	}
+	records, err := zonefile.Parse(file, *origin)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("runImport: %s: %s", path, err)
+	}
+
+	changes, skipped, err := provider.ImportChanges(ctx, zone, records, *prune)
+	if err != nil {
+		return fmt.Errorf("runImport: %s", err)
+	}
+
+	for _, record := range skipped {
+		fmt.Printf("Skipping %s\n", formatRecord(record))
+	}
+	fmt.Printf("Changes to import %s into zone %s:\n", path, zone)
+	printChanges(os.Stdout, changes)
+
+	if *dryRun || isEmpty(changes) {
+		return nil
+	}
+	if !confirm("Apply these changes?", *yes) {
+		fmt.Println("Nothing done")
+		return nil
+	}
+
+	if err := provider.ApplyChanges(ctx, changes); err != nil {
+		return fmt.Errorf("runImport: %s", err)
+	}
+	fmt.Println("Zone file imported")
+	return nil
+}
@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+)
+
+func runZones(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	flags := flag.NewFlagSet("zones", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	jsonOutput := flags.Bool("json", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return fmt.Errorf("runZones: %w", errUsage)
+	}
+
+	zones, err := provider.ManagedZones(ctx)
+	if err != nil {
+		return fmt.Errorf("runZones: %s", err)
+	}
+
+	if *jsonOutput {
+		return writeJson(zones)
+	}
+	for _, zone := range zones {
+		fmt.Println(zone)
+	}
+	return nil
+}
+
+func runRecords(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	flags := flag.NewFlagSet("records", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	jsonOutput := flags.Bool("json", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return fmt.Errorf("runRecords: %w", errUsage)
+	}
+
+	records, err := provider.ZoneRecords(ctx, flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("runRecords: %s", err)
+	}
+
+	if *jsonOutput {
+		return writeJson(records)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tTTL\tTARGETS\tRECORD IDS\tREAD ONLY")
+	for _, record := range records {
+		recordIds, _ := record.GetProviderSpecificProperty(common.RecordIdTag)
+		readOnly := ""
+		if common.IsReadOnly(record) {
+			readOnly = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", record.DNSName, record.RecordType, record.RecordTTL,
+			strings.Join(record.Targets, ","), recordIds, readOnly)
+	}
+	return w.Flush()
+}
+
+func writeJson(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("writeJson: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+)
+
+func runRestore(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	list := flags.Bool("list", false, "")
+	yes := flags.Bool("yes", false, "")
+	dryRun := flags.Bool("dry-run", false, "")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("runRestore: %w", errUsage)
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 || (*list && flags.NArg() != 1) {
+		return fmt.Errorf("runRestore: %w", errUsage)
+	}
+	zone := flags.Arg(0)
+
+	if *list {
+		names, err := provider.Snapshots(zone)
+		if err != nil {
+			return fmt.Errorf("runRestore: %s", err)
+		}
+		if len(names) == 0 {
+			fmt.Printf("No snapshots of zone %s\n", zone)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	snapshot, changes, err := provider.RestoreChanges(ctx, zone, flags.Arg(1))
+	if err != nil {
+		return fmt.Errorf("runRestore: %s", err)
+	}
+
+	fmt.Printf("Changes to restore zone %s as of %s:\n", snapshot.Zone, snapshot.Time.Format("2006-01-02 15:04:05Z07:00"))
+	printChanges(os.Stdout, changes)
+
+	if *dryRun || isEmpty(changes) {
+		return nil
+	}
+	if !confirm("Apply these changes?", *yes) {
+		fmt.Println("Nothing done")
+		return nil
+	}
+
+	if err := provider.ApplyChanges(ctx, changes); err != nil {
+		return fmt.Errorf("runRestore: %s", err)
+	}
+	fmt.Println("Zone restored")
+	return nil
+}
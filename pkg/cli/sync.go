@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+	"sigs.k8s.io/yaml"
+)
+
+func runSync(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	path := flags.String("f", "", "")
+	yes := flags.Bool("yes", false, "")
+	dryRun := flags.Bool("dry-run", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 || *path == "" {
+		return fmt.Errorf("runSync: %w", errUsage)
+	}
+
+	state, err := readDesiredState(*path)
+	if err != nil {
+		return fmt.Errorf("runSync: %s", err)
+	}
+
+	changes, notInFile, err := provider.SyncChanges(ctx, state)
+	if err != nil {
+		return fmt.Errorf("runSync: %s", err)
+	}
+
+	fmt.Printf("Changes to sync zone %s with %s:\n", state.Zone, *path)
+	printChanges(os.Stdout, changes)
+	if len(notInFile) > 0 {
+		fmt.Printf("Not in %s, left alone (list them in the file, or match them with the prune selector to delete them):\n", *path)
+		for _, record := range notInFile {
+			fmt.Printf("  ? %s\n", formatRecord(record))
+		}
+	}
+
+	if *dryRun || isEmpty(changes) {
+		return nil
+	}
+	if !confirm("Apply these changes?", *yes) {
+		fmt.Println("Nothing done")
+		return nil
+	}
+
+	if err := provider.ApplyChanges(ctx, changes); err != nil {
+		return fmt.Errorf("runSync: %s", err)
+	}
+	fmt.Println("Zone synced")
+	return nil
+}
+
+// read the desired state from a YAML or JSON file, or "-" for stdin
+func readDesiredState(path string) (*provider.DesiredState, error) {
+
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("readDesiredState: %s", err)
+	}
+
+	state := &provider.DesiredState{}
+	if err := yaml.UnmarshalStrict(data, state); err != nil {
+		return nil, fmt.Errorf("readDesiredState: %s: %s", path, err)
+	}
+	return state, nil
+}
@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+)
+
+func runUndo(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	flags := flag.NewFlagSet("undo", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	last := flags.Bool("last", false, "")
+	yes := flags.Bool("yes", false, "")
+	dryRun := flags.Bool("dry-run", false, "")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("runUndo: %w", errUsage)
+	}
+
+	var batchId string
+	switch {
+	case *last && flags.NArg() == 0:
+		id, err := provider.LastBatchId()
+		if err != nil {
+			return fmt.Errorf("runUndo: %s", err)
+		}
+		batchId = id
+	case !*last && flags.NArg() == 1:
+		batchId = flags.Arg(0)
+	default:
+		return fmt.Errorf("runUndo: %w", errUsage)
+	}
+
+	changes, notInvertible, err := provider.InverseChanges(batchId)
+	if err != nil {
+		return fmt.Errorf("runUndo: %s", err)
+	}
+
+	fmt.Printf("Changes to undo batch %s:\n", batchId)
+	printChanges(os.Stdout, changes)
+	for _, entry := range notInvertible {
+		fmt.Printf("Cannot undo: %s %s %s %s (previous value unknown)\n", entry.Action, entry.Name, entry.Type, strings.Join(entry.Targets, ","))
+	}
+
+	if *dryRun || isEmpty(changes) {
+		return nil
+	}
+	if !confirm("Apply these changes?", *yes) {
+		fmt.Println("Nothing done")
+		return nil
+	}
+
+	if err := provider.ApplyChanges(ctx, changes); err != nil {
+		return fmt.Errorf("runUndo: %s", err)
+	}
+	fmt.Println("Batch undone")
+	return nil
+}
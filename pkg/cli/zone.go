@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+)
+
+func runZone(ctx context.Context, provider *provider.Provider, args []string) error {
+
+	if len(args) != 2 {
+		return fmt.Errorf("runZone: %w", errUsage)
+	}
+
+	action, zone := args[0], args[1]
+	switch action {
+	case "add":
+		if err := provider.AddZone(ctx, zone); err != nil {
+			return fmt.Errorf("runZone: %s", err)
+		}
+		fmt.Printf("Zone %s added\n", zone)
+	case "delete":
+		if err := provider.DeleteZone(ctx, zone); err != nil {
+			return fmt.Errorf("runZone: %s", err)
+		}
+		fmt.Printf("Zone %s deleted\n", zone)
+	default:
+		return fmt.Errorf("runZone: %w", errUsage)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/audit"
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// build the audit entry for an operation on a single-target record, with
+// the IDs of the batch and requests it's done for
+func auditEntry(ctx context.Context, action string, zone string, record *endpoint.Endpoint, recordId string, previous string, err error) *audit.Entry {
+
+	entry := &audit.Entry{
+		Time:       time.Now().UTC(),
+		BatchId:    common.BatchId(ctx),
+		RequestIds: common.RequestIds(ctx),
+		Action:     action,
+		Zone:       zone,
+		Name:       record.DNSName,
+		Type:       record.RecordType,
+		Targets:    append([]string{}, record.Targets...),
+		TTL:        int64(record.RecordTTL),
+		RecordId:   recordId,
+		Outcome:    audit.OutcomeSuccess,
+	}
+	if previous != "" {
+		entry.PreviousTargets = []string{previous}
+	}
+	if err != nil {
+		entry.Outcome = audit.OutcomeFailure
+		entry.Error = err.Error()
+	}
+	return entry
+}
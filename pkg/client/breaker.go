@@ -0,0 +1,153 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/metrics"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker open, not contacting HE")
+
+// the outcome of a request, as far as the breaker is concerned
+type requestOutcome int
+
+const (
+	outcomeSuccess requestOutcome = iota
+	outcomeFailure
+	// eg the caller went away: says nothing about HE
+	outcomeIgnored
+)
+
+// circuitBreaker stops sending requests to HE after too many consecutive
+// failures (network errors, timeouts, 5xx responses), so that an outage
+// doesn't mean hammering HE with logins and retries. Once the cooldown has
+// passed, a single request is let through: if it succeeds the breaker
+// closes again, otherwise it stays open for another cooldown.
+// A threshold of 0 disables it
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	// a request is being let through while half-open
+	probing bool
+	mutex   sync.Mutex
+	// so tests can move time forward
+	now func() time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	metrics.CircuitBreakerState.Set(0)
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+		now:       time.Now,
+	}
+}
+
+// return an error if the request must not be sent, and whether it's the
+// request let through to probe HE while half-open
+func (b *circuitBreaker) allow() (bool, error) {
+	if b.threshold <= 0 {
+		return false, nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			metrics.CircuitBreakerRejections.Inc()
+			return false, ErrCircuitOpen
+		}
+		log.Infof("Circuit breaker half-open, trying HE again")
+		b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			metrics.CircuitBreakerRejections.Inc()
+			return false, ErrCircuitOpen
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// record the outcome of a request that allow let through. Only the probe
+// decides whether a breaker that isn't closed closes or opens again: a
+// request let through while closed may finish after the breaker opened,
+// and then says nothing about how HE is doing now
+func (b *circuitBreaker) record(probe bool, outcome requestOutcome) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if probe {
+		b.probing = false
+		switch outcome {
+		case outcomeSuccess:
+			log.Infof("Circuit breaker closed, HE is responding again")
+			b.failures = 0
+			b.setState(BreakerClosed)
+		case outcomeFailure:
+			b.failures++
+			log.Warnf("Circuit breaker open again, not contacting HE for %s", b.cooldown)
+			b.openedAt = b.now()
+			b.setState(BreakerOpen)
+		}
+		return
+	}
+
+	if b.state != BreakerClosed {
+		return
+	}
+	switch outcome {
+	case outcomeSuccess:
+		b.failures = 0
+	case outcomeFailure:
+		b.failures++
+		if b.failures >= b.threshold {
+			log.Warnf("Circuit breaker open after %d consecutive failed requests, not contacting HE for %s", b.failures, b.cooldown)
+			b.openedAt = b.now()
+			b.setState(BreakerOpen)
+		}
+	}
+}
+
+// must be called with the mutex held
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	switch state {
+	case BreakerClosed:
+		metrics.CircuitBreakerState.Set(0)
+	case BreakerHalfOpen:
+		metrics.CircuitBreakerState.Set(1)
+	case BreakerOpen:
+		metrics.CircuitBreakerState.Set(2)
+	}
+}
+
+// return the state, the number of consecutive failures, and when the
+// breaker last opened (zero if it never did)
+func (b *circuitBreaker) State() (string, int, time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.threshold <= 0 {
+		return "disabled", b.failures, b.openedAt
+	}
+	return b.state, b.failures, b.openedAt
+}
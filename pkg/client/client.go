@@ -1,6 +1,8 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -9,27 +11,56 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/antchfx/htmlquery"
 	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/audit"
 	"github.com/waldner/external-dns-webhook-he/pkg/common"
 	"github.com/waldner/external-dns-webhook-he/pkg/config"
+	"github.com/waldner/external-dns-webhook-he/pkg/metrics"
+	"golang.org/x/time/rate"
 	"sigs.k8s.io/external-dns/endpoint"
 )
 
 type HEClient struct {
-	config   *config.Config
-	client   *http.Client
+	config *config.Config
+	client *http.Client
+	// held from login to logout: HE has one session per cookie, so the
+	// operations that log in (reads, changes, readiness checks, admin
+	// requests) must not overlap, or the logout of one would end the
+	// session of another
+	session chan struct{}
+	// the page we land on after login, which has the zone list. Only
+	// used by the holder of the session
 	lastBody string
+	// the records of each zone as of the last zone page seen in the session
+	// (HE answers each change with the zone page), so the IDs of the records
+	// to delete can be checked without loading the page again
+	zonePages      map[string][]*endpoint.Endpoint
+	zonePagesMutex sync.Mutex
+	// total number of requests sent to HE
+	requests atomic.Uint64
+	// limits the rate of outbound requests to HE
+	limiter *rate.Limiter
+	// stops sending requests while HE keeps failing
+	breaker *circuitBreaker
+	// decoded TOTP seed, nil if 2FA is not configured
+	totpKey []byte
+	// record operations are written here, nil if disabled
+	auditLog *audit.Logger
 }
 
 const (
-	recordIdTag           = "edns.xdb.me/he-record-id"
 	successfulRemovalMsg  = ">Successfully removed record.<"
 	successfulCreationMsg = ">Successfully added new record to %s<"
 	successfulUpdateMsg   = ">Successfully updated record. <"
 	failedLoginMsg        = ">Incorrect</div>"
-	managingZoneMsg       = ">Managing zone: %s<"
+	// the second login step, when 2FA is enabled on the account
+	totpFormMsg     = `name="tfacode"`
+	managingZoneMsg = ">Managing zone: %s<"
 )
 
 func NewClient(config *config.Config) (*HEClient, error) {
@@ -39,24 +70,90 @@ func NewClient(config *config.Config) (*HEClient, error) {
 		return nil, fmt.Errorf("NewClient: error creating cookie jar: %s", err)
 	}
 
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, fmt.Errorf("NewClient: %s", err)
+	}
+
 	client := &http.Client{
-		Jar: jar,
+		Jar:       jar,
+		Transport: transport,
+	}
+
+	var totpKey []byte
+	if config.TotpSecret != "" {
+		totpKey, err = decodeTotpSecret(config.TotpSecret)
+		if err != nil {
+			return nil, fmt.Errorf("NewClient: %s", err)
+		}
+	}
+
+	auditLog, err := audit.NewLogger(config.AuditLog, config.AuditLogMaxSize, config.AuditLogMaxFiles)
+	if err != nil {
+		return nil, fmt.Errorf("NewClient: %s", err)
+	}
+
+	limit := rate.Inf
+	metrics.RateLimit.Set(0)
+	if config.MaxRequestsPerSecond > 0 {
+		limit = rate.Limit(config.MaxRequestsPerSecond)
+		metrics.RateLimit.Set(float64(config.MaxRequestsPerSecond))
 	}
 
 	return &HEClient{
-		config,
-		client,
-		"",
+		config:    config,
+		client:    client,
+		session:   make(chan struct{}, 1),
+		lastBody:  "",
+		zonePages: map[string][]*endpoint.Endpoint{},
+		limiter:   rate.NewLimiter(limit, 1),
+		breaker:   newCircuitBreaker(config.BreakerThreshold, config.BreakerCooldown),
+		totpKey:   totpKey,
+		auditLog:  auditLog,
 	}, nil
 
 }
 
-func (c *HEClient) DoLogin() error {
+// start a session, waiting for the one in progress (if any) to end.
+// If the login fails, there's no session to log out of
+func (c *HEClient) DoLogin(ctx context.Context) error {
+	select {
+	case c.session <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("DoLogin: waiting for another session to end: %s", ctx.Err())
+	}
+	return c.startSession(ctx)
+}
+
+// like DoLogin, but if another session is in progress return false right
+// away, instead of waiting for it to end
+func (c *HEClient) TryLogin(ctx context.Context) (bool, error) {
+	select {
+	case c.session <- struct{}{}:
+	default:
+		return false, nil
+	}
+	return true, c.startSession(ctx)
+}
+
+// log in, once the session is ours
+func (c *HEClient) startSession(ctx context.Context) error {
+	// what was seen in another session may have changed since
+	c.forgetZonePages()
+	err := c.doLogin(ctx)
+	if err != nil {
+		metrics.LoginFailures.Inc()
+		c.endSession()
+	}
+	return err
+}
+
+func (c *HEClient) doLogin(ctx context.Context) error {
 
 	// fetch initial page to get the cookie
-	_, err := c.getPage(c.config.Url)
+	_, _, err := c.getPage(ctx, metrics.PageLogin, c.config.Url)
 	if err != nil {
-		return fmt.Errorf("DoLogin: %s", err)
+		return fmt.Errorf("DoLogin: %w", err)
 	}
 
 	log.Debugf("Logging in as user '%s'", c.config.Username)
@@ -65,105 +162,290 @@ func (c *HEClient) DoLogin() error {
 	postData.Set("pass", c.config.Password)
 	postData.Set("submit", "Login!")
 
-	_, err = c.postPage(c.config.Url, &postData)
+	_, body, err := c.postPage(ctx, metrics.PageLogin, c.config.Url, &postData)
 	if err != nil {
-		return fmt.Errorf("DoLogin: %s", err)
+		return fmt.Errorf("DoLogin: %w", err)
 	}
 
-	if checkInPage(c.lastBody, failedLoginMsg) {
+	if checkInPage(body, failedLoginMsg) {
 		return fmt.Errorf("DoLogin: Login failed (invalid credentials?)")
 	}
 
+	if checkInPage(body, totpFormMsg) {
+		body, err = c.submitTotp(ctx)
+		if err != nil {
+			return fmt.Errorf("DoLogin: %s", err)
+		}
+	}
+
+	c.lastBody = body
 	return nil
 }
 
-func (c *HEClient) DoLogout() error {
+// HE asks for the 2FA code after the password, with a second form
+func (c *HEClient) submitTotp(ctx context.Context) (string, error) {
+
+	if c.totpKey == nil {
+		return "", fmt.Errorf("submitTotp: HE asks for a 2FA code, but no TOTP secret is configured")
+	}
+
+	log.Debugf("Submitting 2FA code")
+	postData := url.Values{}
+	postData.Set("tfacode", generateTotp(c.totpKey, time.Now()))
+	postData.Set("submit", "Submit")
+
+	_, body, err := c.postPage(ctx, metrics.PageTotp, c.config.Url, &postData)
+	if err != nil {
+		return "", fmt.Errorf("submitTotp: %s", err)
+	}
+
+	if checkInPage(body, failedLoginMsg) || checkInPage(body, totpFormMsg) {
+		return "", fmt.Errorf("submitTotp: 2FA code rejected (wrong secret or clock out of sync?)")
+	}
+	return body, nil
+}
+
+// the session ends even if the logout request fails
+func (c *HEClient) DoLogout(ctx context.Context) error {
+	defer c.endSession()
 	log.Debugf("Logging out...")
-	_, err := c.getPage(c.config.Url + "?action=logout") // TODO response
+	_, _, err := c.getPage(ctx, metrics.PageLogout, c.config.Url+"?action=logout") // TODO response
 	return err
 }
 
-func (c *HEClient) getZonePage(zone string, zoneData *common.ZoneData) error {
+func (c *HEClient) endSession() {
+	select {
+	case <-c.session:
+	default:
+	}
+}
+
+// return the body of the zone page. Pages are not shared between calls,
+// so several zones can be fetched at the same time
+func (c *HEClient) getZonePage(ctx context.Context, zone string, zoneData *common.ZoneData) (string, error) {
 	url := c.config.Url + zoneData.TargetLink
-	response, err := c.getPage(url)
+	response, body, err := c.getPage(ctx, metrics.PageZone, url)
 	if err != nil {
-		return fmt.Errorf("getZonePage: %s", err)
+		return "", fmt.Errorf("getZonePage: %s", err)
 	}
 
 	if response.StatusCode != 200 {
-		return fmt.Errorf("getZonePage: unexpected response status: %s", response.Status)
+		return "", fmt.Errorf("getZonePage: unexpected response status: %s", response.Status)
 	}
 
-	if !checkInPage(c.lastBody, fmt.Sprintf(managingZoneMsg, zone)) {
-		return fmt.Errorf("getZonePage: Expected text not found in zone page")
+	if !checkInPage(body, fmt.Sprintf(managingZoneMsg, zone)) {
+		return "", fmt.Errorf("getZonePage: Expected text not found in zone page")
 	}
 
+	return body, nil
+
+}
+
+// wait until the rate limiter allows another request to HE
+func (c *HEClient) waitForLimiter(ctx context.Context) error {
+	start := time.Now()
+	err := c.limiter.Wait(ctx)
+	metrics.RateLimitWait.Add(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("waitForLimiter: %s", err)
+	}
+	c.requests.Add(1)
 	return nil
+}
+
+// each request has its own deadline, on top of that of the whole operation
+func (c *HEClient) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.config.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, c.config.RequestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (c *HEClient) setUserAgent(request *http.Request) {
+	if c.config.UserAgent != "" {
+		request.Header.Set("User-Agent", c.config.UserAgent)
+	}
+}
 
+// record the result and latency of a request to HE
+func observeRequest(page string, start time.Time, response *http.Response, err error) {
+	result := "error"
+	if err == nil {
+		result = strconv.Itoa(response.StatusCode)
+	}
+	metrics.HeRequests.WithLabelValues(page, result).Inc()
+	metrics.HeRequestDuration.WithLabelValues(page).Observe(time.Since(start).Seconds())
 }
 
-func (c *HEClient) getPage(url string) (*http.Response, error) {
+// what the request says about HE, for the circuit breaker: a request that
+// fails because its own caller went away doesn't count. ctx is the context
+// of the request, so its own timeout counts as a failure
+func requestResult(ctx context.Context, response *http.Response, err error) requestOutcome {
+	switch {
+	case err != nil && errors.Is(err, context.Canceled) && ctx.Err() == context.Canceled:
+		return outcomeIgnored
+	case err != nil || response.StatusCode >= 500:
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+// page is the kind of page requested, only used for the metrics
+func (c *HEClient) getPage(ctx context.Context, page string, url string) (*http.Response, string, error) {
+
+	probe, err := c.breaker.allow()
+	if err != nil {
+		return nil, "", fmt.Errorf("getPage: %w", err)
+	}
+	if err := c.waitForLimiter(ctx); err != nil {
+		c.breaker.record(probe, outcomeIgnored)
+		return nil, "", fmt.Errorf("getPage: %s", err)
+	}
+
+	ctx, cancel := c.requestContext(ctx)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		c.breaker.record(probe, outcomeIgnored)
+		return nil, "", fmt.Errorf("getPage: Error creating request for page '%s': %s", url, err)
+	}
+	c.setUserAgent(request)
 
 	log.Debugf("Navigating to page '%s'", url)
-	response, err := c.client.Get(url)
+	start := time.Now()
+	response, err := c.client.Do(request)
+	observeRequest(page, start, response, err)
+	c.breaker.record(probe, requestResult(ctx, response, err))
 	if err != nil {
-		return nil, fmt.Errorf("getPage: Error fetching page '%s': %s", url, err)
+		return nil, "", fmt.Errorf("getPage: Error fetching page '%s': %s", url, err)
 	}
 
 	log.Debugf("Page '%s' response: status %s, headers %s", url, response.Status, response.Header)
 
 	body, err := readBody(response)
 	if err != nil {
-		return nil, fmt.Errorf("getPage: %s", err)
+		return nil, "", fmt.Errorf("getPage: %s", err)
 	}
 	//log.Debugf("Body is %s", body)
 
-	c.lastBody = body
-	return response, nil
+	return response, body, nil
 }
 
-func (c *HEClient) postPage(url string, postData *url.Values) (*http.Response, error) {
+func (c *HEClient) postPage(ctx context.Context, page string, url string, postData *url.Values) (*http.Response, string, error) {
+
+	probe, err := c.breaker.allow()
+	if err != nil {
+		return nil, "", fmt.Errorf("postPage: %w", err)
+	}
+	if err := c.waitForLimiter(ctx); err != nil {
+		c.breaker.record(probe, outcomeIgnored)
+		return nil, "", fmt.Errorf("postPage: %s", err)
+	}
+
+	ctx, cancel := c.requestContext(ctx)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(postData.Encode()))
+	if err != nil {
+		c.breaker.record(probe, outcomeIgnored)
+		return nil, "", fmt.Errorf("postPage: error creating request: %s", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c.setUserAgent(request)
 
 	log.Debugf("Posting data to page %s", url)
 
-	response, err := c.client.PostForm(url, *postData)
+	start := time.Now()
+	response, err := c.client.Do(request)
+	observeRequest(page, start, response, err)
+	c.breaker.record(probe, requestResult(ctx, response, err))
 	if err != nil {
-		return nil, fmt.Errorf("postPage: submission error: %s", err)
+		return nil, "", fmt.Errorf("postPage: submission error: %s", err)
 	}
 
 	log.Debugf("Page %s response: status %s, headers %s", url, response.Status, response.Header)
 	body, err := readBody(response)
 	if err != nil {
-		return nil, fmt.Errorf("postPage: %s", err)
+		return nil, "", fmt.Errorf("postPage: %s", err)
 	}
 
 	//log.Debugf("Body is %s", body)
-	c.lastBody = body
-	return response, nil
+	return response, body, nil
+}
+
+// return the state of the circuit breaker, the number of consecutive
+// failed requests, and when it last opened (zero if it never did)
+func (c *HEClient) CircuitBreakerState() (string, int, time.Time) {
+	return c.breaker.State()
+}
+
+// return the number of requests sent to HE so far
+func (c *HEClient) RequestCount() uint64 {
+	return c.requests.Load()
+}
+
+// return the configured rate (0 if unlimited) and the requests that
+// can be sent right now without waiting
+func (c *HEClient) RateLimiterState() (float64, float64) {
+	if c.limiter.Limit() == rate.Inf {
+		return 0, 0
+	}
+	return float64(c.limiter.Limit()), c.limiter.Tokens()
 }
 
-func (c *HEClient) GetMatchingZones(domainFilter *endpoint.DomainFilter) (map[string]*common.ZoneData, error) {
+// the zone list is the page we land on after login, so this
+// doesn't need to send any request
+func (c *HEClient) GetMatchingZones(ctx context.Context, domainFilter *endpoint.DomainFilter) (map[string]*common.ZoneData, error) {
 
 	log.Infof("Getting matching domain list")
 
-	tree, err := htmlquery.Parse(strings.NewReader(c.lastBody))
+	allZones, err := parseZones(c.lastBody)
 	if err != nil {
-		return nil, fmt.Errorf("GetMatchingZones: error parsing body: %s", err)
+		return nil, fmt.Errorf("GetMatchingZones: %s", err)
 	}
 
+	// look for wanted zones
 	zones := map[string]*common.ZoneData{}
+	for zone, zoneData := range allZones {
+		if domainFilter.Match(zone) {
+			zones[zone] = zoneData
+		}
+	}
 
-	// look for wanted zones
-	for _, tr := range htmlquery.Find(tree, "//table[@id='domains_table']/tbody/tr") {
-		z := htmlquery.InnerText(htmlquery.Find(tr, "./td[3]/span")[0])
-		if !domainFilter.Match(z) {
-			continue
+	return zones, nil
+}
+
+// return all the zones in the domains_table of the page
+func parseZones(body string) (map[string]*common.ZoneData, error) {
+
+	tree, err := htmlquery.Parse(strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("parseZones: error parsing body: %s", err)
+	}
+
+	// if the table is not there, we're not logged in or the page has changed
+	if htmlquery.FindOne(tree, "//table[@id='domains_table']") == nil {
+		return nil, fmt.Errorf("parseZones: zone list not found in page")
+	}
+
+	zones := map[string]*common.ZoneData{}
+
+	for i, tr := range htmlquery.Find(tree, "//table[@id='domains_table']/tbody/tr") {
+		span := htmlquery.FindOne(tr, "./td[3]/span")
+		img := htmlquery.FindOne(tr, "./td[2]/img")
+		if span == nil || img == nil {
+			return nil, fmt.Errorf("parseZones: unexpected layout of row %d of the zone list", i+1)
 		}
+		z := htmlquery.InnerText(span)
 
-		href := htmlquery.SelectAttr(htmlquery.Find(tr, "./td[2]/img")[0], "onclick")
+		href := htmlquery.SelectAttr(img, "onclick")
 		m := regexp.MustCompile(`^javascript:document\.location\.href='(.*)'$`)
 		targetLink := m.ReplaceAllString(href, "$1")
 		m = regexp.MustCompile(`.*hosted_dns_zoneid=(\d+).*`)
+		if !m.MatchString(targetLink) {
+			return nil, fmt.Errorf("parseZones: zone ID not found in row %d of the zone list", i+1)
+		}
 		hostedDnsZoneId := m.ReplaceAllString(targetLink, "$1")
 		zones[z] = &common.ZoneData{
 			TargetLink:      targetLink,
@@ -174,19 +456,149 @@ func (c *HEClient) GetMatchingZones(domainFilter *endpoint.DomainFilter) (map[st
 	return zones, nil
 }
 
-func (c *HEClient) GetZoneEndpoints(zone string, zoneData *common.ZoneData) ([]*endpoint.Endpoint, error) {
+// load the zone list again, so that GetMatchingZones sees the zones
+// added or deleted during this session
+func (c *HEClient) reloadZones(ctx context.Context) (map[string]*common.ZoneData, error) {
+
+	_, body, err := c.getPage(ctx, metrics.PageZoneList, c.config.Url)
+	if err != nil {
+		return nil, fmt.Errorf("reloadZones: %s", err)
+	}
+	zones, err := parseZones(body)
+	if err != nil {
+		return nil, fmt.Errorf("reloadZones: %s", err)
+	}
+	c.lastBody = body
+	return zones, nil
+}
+
+// submit the add domain form. HE doesn't say much about failures (eg the
+// zone already exists in another account), so we check that the zone
+// appears in the zone list
+func (c *HEClient) AddZone(ctx context.Context, zone string) error {
+
+	log.Infof("Adding zone %s", zone)
+
+	postData := url.Values{}
+	postData.Set("action", "add_zone")
+	postData.Set("retmain", "0")
+	postData.Set("add_domain", zone)
+	postData.Set("submit", "Add Domain!")
+
+	response, _, err := c.postPage(ctx, metrics.PageZoneAdd, c.config.Url+"/index.cgi", &postData)
+	if err != nil {
+		return fmt.Errorf("AddZone: %s", err)
+	}
+	if response.StatusCode != 200 {
+		return fmt.Errorf("AddZone: got invalid status code %d", response.StatusCode)
+	}
+
+	zones, err := c.reloadZones(ctx)
+	if err != nil {
+		return fmt.Errorf("AddZone: %s", err)
+	}
+	if _, ok := zones[zone]; !ok {
+		return fmt.Errorf("AddZone: zone %s not found in the zone list after adding it", zone)
+	}
+
+	log.Infof("Successfully added zone %s", zone)
+	return nil
+}
+
+// submit the delete domain form, and check that the zone is gone
+func (c *HEClient) DeleteZone(ctx context.Context, zone string, zoneData *common.ZoneData) error {
+
+	log.Infof("Deleting zone %s (%s)", zone, zoneData.HostedDnsZoneId)
+
+	postData := url.Values{}
+	postData.Set("delete_id", zoneData.HostedDnsZoneId)
+	postData.Set("remove_domain", "1")
+
+	response, _, err := c.postPage(ctx, metrics.PageZoneDelete, c.config.Url+"/index.cgi", &postData)
+	if err != nil {
+		return fmt.Errorf("DeleteZone: %s", err)
+	}
+	if response.StatusCode != 200 {
+		return fmt.Errorf("DeleteZone: got invalid status code %d", response.StatusCode)
+	}
+
+	zones, err := c.reloadZones(ctx)
+	if err != nil {
+		return fmt.Errorf("DeleteZone: %s", err)
+	}
+	if _, ok := zones[zone]; ok {
+		return fmt.Errorf("DeleteZone: zone %s still in the zone list after deleting it", zone)
+	}
+
+	log.Infof("Successfully deleted zone %s", zone)
+	return nil
+}
+
+func (c *HEClient) GetZoneEndpoints(ctx context.Context, zone string, zoneData *common.ZoneData) ([]*endpoint.Endpoint, error) {
 
 	log.Infof("Getting endpoints for zone %s", zone)
 	log.Debugf("Zone data is %s", *zoneData)
 
-	err := c.getZonePage(zone, zoneData)
+	body, err := c.getZonePage(ctx, zone, zoneData)
 	if err != nil {
 		return nil, fmt.Errorf("GetZoneEndpoints: %s", err)
 	}
 
-	tree, err := htmlquery.Parse(strings.NewReader(c.lastBody))
+	endpoints, err := parseZoneRecords(zone, zoneData, body)
 	if err != nil {
-		return nil, fmt.Errorf("GetZoneEndpoints: parsing HTML body: %s", err)
+		return nil, fmt.Errorf("GetZoneEndpoints: %s", err)
+	}
+	c.setZonePage(zone, endpoints)
+
+	// HE has one row per target, but external-dns wants a single
+	// endpoint with all the targets
+	return common.AggregateRecords(endpoints), nil
+}
+
+func (c *HEClient) setZonePage(zone string, records []*endpoint.Endpoint) {
+	c.zonePagesMutex.Lock()
+	defer c.zonePagesMutex.Unlock()
+	c.zonePages[zone] = records
+}
+
+func (c *HEClient) forgetZonePages() {
+	c.zonePagesMutex.Lock()
+	defer c.zonePagesMutex.Unlock()
+	c.zonePages = map[string][]*endpoint.Endpoint{}
+}
+
+// keep the records of the zone page HE answered a change with, if it is one
+func (c *HEClient) updateZonePage(zone string, zoneData *common.ZoneData, body string) {
+	if !checkInPage(body, fmt.Sprintf(managingZoneMsg, zone)) {
+		return
+	}
+	if records, err := parseZoneRecords(zone, zoneData, body); err == nil {
+		c.setZonePage(zone, records)
+	}
+}
+
+// return the records of the zone, one per row, loading the zone page only
+// if it wasn't seen yet in this session
+func (c *HEClient) zoneRecords(ctx context.Context, zone string, zoneData *common.ZoneData) ([]*endpoint.Endpoint, error) {
+	c.zonePagesMutex.Lock()
+	records := c.zonePages[zone]
+	c.zonePagesMutex.Unlock()
+	if records != nil {
+		return records, nil
+	}
+	records, err := c.GetZoneEndpoints(ctx, zone, zoneData)
+	if err != nil {
+		return nil, fmt.Errorf("zoneRecords: %s", err)
+	}
+	return common.ExpandRecords(records), nil
+}
+
+// return the records in the zone page, one per row
+func parseZoneRecords(zone string, zoneData *common.ZoneData, body string) ([]*endpoint.Endpoint, error) {
+
+	tree, err := htmlquery.Parse(strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("parseZoneRecords: parsing HTML body: %s", err)
 	}
 
 	/*
@@ -241,6 +653,15 @@ func (c *HEClient) GetZoneEndpoints(zone string, zoneData *common.ZoneData) ([]*
 		td = htmlquery.FindOne(tr, "./td[7]")
 		recordData := htmlquery.SelectAttr(td, "data")
 
+		// HE shows the priority of MX and SRV records in its own column, but
+		// external-dns (and the master file syntax) have it in the data
+		recordPriority := strings.TrimSpace(htmlquery.InnerText(htmlquery.FindOne(tr, "./td[6]")))
+		if hasPriority(recordType) {
+			if _, err := strconv.Atoi(recordPriority); err == nil {
+				recordData = recordPriority + " " + recordData
+			}
+		}
+
 		recordTtl := htmlquery.InnerText(htmlquery.FindOne(tr, "./td[5]"))
 
 		intTtl, err := strconv.Atoi(recordTtl)
@@ -250,7 +671,11 @@ func (c *HEClient) GetZoneEndpoints(zone string, zoneData *common.ZoneData) ([]*
 		}
 
 		ep := endpoint.NewEndpointWithTTL(recordName, recordType, endpoint.TTL(intTtl), recordData)
-		ep = ep.WithProviderSpecific(recordIdTag, recordId)
+		ep = ep.WithProviderSpecific(common.RecordIdTag, recordId)
+		// locked rows (SOA, NS) are managed by HE and cannot be edited
+		if htmlquery.SelectAttr(tr, "class") == "dns_tr_locked" {
+			ep = ep.WithProviderSpecific(common.ReadOnlyTag, "true")
+		}
 		log.Debugf("Zone %s (%s): read record %s", zone, zoneData.HostedDnsZoneId, ep)
 		endpoints = append(endpoints, ep)
 	}
@@ -270,17 +695,15 @@ func readBody(response *http.Response) (string, error) {
 
 }
 
-func (c *HEClient) CreateRecords(zone string, zoneData *common.ZoneData, records []*endpoint.Endpoint) error {
-
-	// go to the zone page and read all existing records in page
-	existingRecords, err := c.GetZoneEndpoints(zone, zoneData)
-	if err != nil {
-		return fmt.Errorf("CreateRecords: %s", err)
-	}
+// creations are posted directly, there's no need to load the zone page first
+func (c *HEClient) CreateRecords(ctx context.Context, zone string, zoneData *common.ZoneData, records []*endpoint.Endpoint) error {
 
 	log.Infof("==== Start record creation ====")
-	for _, record := range records {
-		err = c.createRecord(zone, zoneData, existingRecords, record)
+	for _, record := range common.ExpandRecords(records) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("CreateRecords: stopping before creation of %s: %s", record, err)
+		}
+		err := c.createRecord(ctx, zone, zoneData, record)
 		if err != nil {
 			return fmt.Errorf("CreateRecords: %s", err)
 		}
@@ -289,58 +712,170 @@ func (c *HEClient) CreateRecords(zone string, zoneData *common.ZoneData, records
 	return nil
 }
 
-func (c *HEClient) createRecord(zone string, zoneData *common.ZoneData, existingRecords []*endpoint.Endpoint, record *endpoint.Endpoint) error {
+func (c *HEClient) createRecord(ctx context.Context, zone string, zoneData *common.ZoneData, record *endpoint.Endpoint) error {
 
 	log.Infof("Creating record %s", record)
 
+	recordId, err := c.submitRecord(ctx, zone, zoneData, record, "")
+	// what HE actually stores
+	created := endpoint.NewEndpointWithTTL(record.DNSName, record.RecordType, submittedTtl, record.Targets...)
+	c.auditLog.Log(auditEntry(ctx, audit.ActionCreate, zone, created, recordId, "", err))
+	if err != nil {
+		return fmt.Errorf("createRecord: %s", err)
+	}
+
+	log.Infof("Successfully created record")
+
+	return nil
+}
+
+// each record must carry the HE record ID of the record it replaces
+func (c *HEClient) UpdateRecords(ctx context.Context, zone string, zoneData *common.ZoneData, records []*endpoint.Endpoint) error {
+
+	log.Infof("==== Start record update ====")
+	for _, ep := range records {
+		// the replaced target, if known, is only needed for the audit log
+		previous, _ := ep.GetProviderSpecificProperty(common.PreviousTargetTag)
+		for _, record := range common.ExpandRecords([]*endpoint.Endpoint{ep}) {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("UpdateRecords: stopping before update of %s: %s", record, err)
+			}
+			err := c.updateRecord(ctx, zone, zoneData, record, previous)
+			if err != nil {
+				return fmt.Errorf("UpdateRecords: %s", err)
+			}
+		}
+	}
+	log.Infof("==== End record update ====")
+	return nil
+}
+
+func (c *HEClient) updateRecord(ctx context.Context, zone string, zoneData *common.ZoneData, record *endpoint.Endpoint, previous string) error {
+
+	log.Infof("Updating record %s", record)
+
+	recordId, _ := record.GetProviderSpecificProperty(common.RecordIdTag)
+	if recordId == "" {
+		return fmt.Errorf("updateRecord: record %s has no record ID", record)
+	}
+
+	_, err := c.submitRecord(ctx, zone, zoneData, record, recordId)
+	updated := endpoint.NewEndpointWithTTL(record.DNSName, record.RecordType, submittedTtl, record.Targets...)
+	c.auditLog.Log(auditEntry(ctx, audit.ActionUpdate, zone, updated, recordId, previous, err))
+	if err != nil {
+		return fmt.Errorf("updateRecord: %s", err)
+	}
+
+	log.Infof("Successfully updated record")
+
+	return nil
+}
+
+func hasPriority(recordType string) bool {
+	return recordType == "MX" || recordType == "SRV"
+}
+
+// split the priority from the target of MX and SRV records, which HE wants in its own field
+func splitPriority(recordType string, target string) (string, string) {
+	if hasPriority(recordType) {
+		if priority, content, ok := strings.Cut(strings.TrimSpace(target), " "); ok {
+			if _, err := strconv.Atoi(priority); err == nil {
+				return priority, strings.TrimSpace(content)
+			}
+		}
+	}
+	return "", target
+}
+
+// the TTL of the records we create or update
+const submittedTtl endpoint.TTL = 300
+
+// submit the record edit form: with an empty record ID a new record
+// is created, otherwise the record with that ID is overwritten.
+// Return the ID of the record, if known
+func (c *HEClient) submitRecord(ctx context.Context, zone string, zoneData *common.ZoneData, record *endpoint.Endpoint, recordId string) (string, error) {
+
 	postData := url.Values{}
 	postData.Set("account", "")
 	postData.Set("menu", "edit_zone")
 	postData.Set("Type", record.RecordType)
 	postData.Set("hosted_dns_zoneid", zoneData.HostedDnsZoneId)
-	postData.Set("hosted_dns_recordid", "")
+	postData.Set("hosted_dns_recordid", recordId)
 	postData.Set("hosted_dns_editzone", "1")
-	postData.Set("Priority", "")
+	priority, content := splitPriority(record.RecordType, record.Targets[0])
+	postData.Set("Priority", priority)
 	postData.Set("Name", record.DNSName)
-	postData.Set("Content", record.Targets[0])
+	postData.Set("Content", content)
 	// TTL is always 0, so set it to 300
-	postData.Set("TTL", "300") //strconv.FormatInt(int64(record.RecordTTL), 10))
+	postData.Set("TTL", strconv.FormatInt(int64(submittedTtl), 10)) //strconv.FormatInt(int64(record.RecordTTL), 10))
 	postData.Set("hosted_dns_editrecord", "Submit")
 
-	response, err := c.postPage(c.config.Url+"/index.cgi", &postData)
+	page := metrics.PageCreate
+	if recordId != "" {
+		page = metrics.PageUpdate
+	}
+	response, body, err := c.postPage(ctx, page, c.config.Url+"/index.cgi", &postData)
+	// whatever happened, the zone may have changed
+	c.setZonePage(zone, nil)
 	if err != nil {
-		return fmt.Errorf("createRecord: %s", err)
+		return recordId, fmt.Errorf("submitRecord: %s", err)
 	}
 
 	// check also that the HTTP code is correct
 	if response.StatusCode != 200 {
-		return fmt.Errorf("createRecord: got invalid status code after creation/update of record %s: %v", record, response.StatusCode)
+		return recordId, fmt.Errorf("submitRecord: got invalid status code after creation/update of record %s: %v", record, response.StatusCode)
 	}
 
 	// check that we're on the right page: there should be a ">Successfully added new record to {domain}<" message
 	// or, if it was an update, a "Successfully updated record" message
-
-	if !checkInPage(c.lastBody, fmt.Sprintf(successfulCreationMsg, zone)) {
-		return fmt.Errorf("createRecord: cannot find the expected creation message in page")
+	if recordId == "" {
+		if !checkInPage(body, fmt.Sprintf(successfulCreationMsg, zone)) {
+			return "", fmt.Errorf("submitRecord: cannot find the expected creation message in page")
+		}
+		// we land on the zone page, where the new record can be found
+		c.updateZonePage(zone, zoneData, body)
+		return findRecordId(zone, zoneData, body, record), nil
 	}
+	if !checkInPage(body, successfulUpdateMsg) {
+		return recordId, fmt.Errorf("submitRecord: cannot find the expected update message in page")
+	}
+	c.updateZonePage(zone, zoneData, body)
 
-	log.Infof("Successfully created record")
-
-	return nil
+	return recordId, nil
 }
 
-// we have already determined the zone where we create or delete the records
-func (c *HEClient) DeleteRecords(zone string, zoneData *common.ZoneData, records []*endpoint.Endpoint) error {
-
-	// go to the zone page and read all existing records in page
-	existingRecords, err := c.GetZoneEndpoints(zone, zoneData)
+// return the ID of the record in the zone page, or an empty string if not found
+func findRecordId(zone string, zoneData *common.ZoneData, body string, record *endpoint.Endpoint) string {
+	records, err := parseZoneRecords(zone, zoneData, body)
 	if err != nil {
-		return fmt.Errorf("deleteRecords: %s", err)
+		log.Debugf("findRecordId: %s", err)
+		return ""
+	}
+	for _, existing := range records {
+		if isSameRecord(existing, record) {
+			recordId, _ := existing.GetProviderSpecificProperty(common.RecordIdTag)
+			return recordId
+		}
 	}
+	return ""
+}
+
+// we have already determined the zone where we create or delete the records.
+// Records are deleted using their HE record ID, once checked against the
+// zone page: it's only loaded if it wasn't seen yet in this session
+func (c *HEClient) DeleteRecords(ctx context.Context, zone string, zoneData *common.ZoneData, records []*endpoint.Endpoint) error {
 
 	log.Infof("==== Start record deletion ====")
-	for _, record := range records {
-		err = c.deleteRecord(zone, zoneData, existingRecords, record)
+	for _, record := range common.ExpandRecords(records) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("DeleteRecords: stopping before deletion of %s: %s", record, err)
+		}
+		// after each deletion, from the page HE answers with
+		existingRecords, err := c.zoneRecords(ctx, zone, zoneData)
+		if err != nil {
+			return fmt.Errorf("DeleteRecords: %s", err)
+		}
+		err = c.deleteRecord(ctx, zone, zoneData, existingRecords, record)
 		if err != nil {
 			return fmt.Errorf("DeleteRecords: %s", err)
 		}
@@ -349,25 +884,53 @@ func (c *HEClient) DeleteRecords(zone string, zoneData *common.ZoneData, records
 	return nil
 }
 
-func (c *HEClient) deleteRecord(zone string, zoneData *common.ZoneData, existingRecords []*endpoint.Endpoint, record *endpoint.Endpoint) error {
+func (c *HEClient) deleteRecord(ctx context.Context, zone string, zoneData *common.ZoneData, existingRecords []*endpoint.Endpoint, record *endpoint.Endpoint) error {
 
 	//https://dns.he.net/?hosted_dns_zoneid=999999&menu=edit_zone&hosted_dns_editzone
 
 	log.Infof("Deleting record: %s", record)
 
-	// iterate to find the record ID
-	recordId := ""
+	// if the record already carries its ID, use it as long as it really
+	// identifies this record (it may be stale, or come from a file), otherwise
+	// look for the record by name, type and target
+	recordId, _ := record.GetProviderSpecificProperty(common.RecordIdTag)
+	var found *endpoint.Endpoint
 	for _, existingRecord := range existingRecords {
-		if isSameRecord(existingRecord, record) {
-			recordId, _ = existingRecord.GetProviderSpecificProperty(recordIdTag)
-			break
+		if !isSameRecord(existingRecord, record) {
+			continue
+		}
+		if existingId, _ := existingRecord.GetProviderSpecificProperty(common.RecordIdTag); found == nil || existingId == recordId {
+			found = existingRecord
 		}
 	}
 
-	if recordId == "" {
+	if found == nil {
 		log.Warnf("Record %s not found, nothing to do, returning", record)
+		entry := auditEntry(ctx, audit.ActionDelete, zone, record, "", "", nil)
+		entry.Outcome = audit.OutcomeSkipped
+		c.auditLog.Log(entry)
 		return nil
 	}
+	existingId, _ := found.GetProviderSpecificProperty(common.RecordIdTag)
+	if recordId != "" && recordId != existingId {
+		log.Warnf("Record %s has ID %s, but in the zone it's record %s, deleting that", record, recordId, existingId)
+	}
+	recordId = existingId
+	// with the actual TTL, for the audit log
+	record = found
+
+	err := c.submitDeletion(ctx, zone, zoneData, recordId)
+	c.auditLog.Log(auditEntry(ctx, audit.ActionDelete, zone, record, recordId, "", err))
+	if err != nil {
+		return fmt.Errorf("deleteRecord: %s", err)
+	}
+
+	log.Infof("Successfully deleted record")
+	return nil
+}
+
+// submit the deletion of the record with the given ID
+func (c *HEClient) submitDeletion(ctx context.Context, zone string, zoneData *common.ZoneData, recordId string) error {
 
 	postData := url.Values{}
 	postData.Set("hosted_dns_zoneid", zoneData.HostedDnsZoneId)
@@ -377,21 +940,22 @@ func (c *HEClient) deleteRecord(zone string, zoneData *common.ZoneData, existing
 	postData.Set("hosted_dns_editzone", "1")
 	postData.Set("hosted_dns_delrecord", "1")
 
-	response, err := c.postPage(c.config.Url+"/index.cgi", &postData)
+	response, body, err := c.postPage(ctx, metrics.PageDelete, c.config.Url+"/index.cgi", &postData)
+	// whatever happened, the zone may have changed
+	c.setZonePage(zone, nil)
 	if err != nil {
-		return fmt.Errorf("deleteRecord: %s", err)
+		return fmt.Errorf("submitDeletion: %s", err)
 	}
 
 	// check that the HTTP code is correct
 	if response.StatusCode != 200 {
-		return fmt.Errorf("deleteRecord: got invalid status code %d", response.StatusCode)
+		return fmt.Errorf("submitDeletion: got invalid status code %d", response.StatusCode)
 	}
 	// check that we're on the right page: there should be a ">Successfully removed record.<" message
-	if !checkInPage(c.lastBody, successfulRemovalMsg) {
-		return fmt.Errorf("deleteRecord: cannot find the successful deletion message in page")
+	if !checkInPage(body, successfulRemovalMsg) {
+		return fmt.Errorf("submitDeletion: cannot find the successful deletion message in page")
 	}
-
-	log.Infof("Successfully deleted record")
+	c.updateZonePage(zone, zoneData, body)
 	return nil
 }
 
@@ -0,0 +1,471 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/waldner/external-dns-webhook-he/internal/fakehe"
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"github.com/waldner/external-dns-webhook-he/pkg/config"
+	"github.com/waldner/external-dns-webhook-he/pkg/metrics"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestGenerateTotp(t *testing.T) {
+
+	key, err := decodeTotpSecret(strings.ToLower(fakehe.TotpSecret))
+	if err != nil {
+		t.Fatalf("decodeTotpSecret should not have failed, but got: %s", err)
+	}
+
+	// RFC 6238 SHA1 test vectors, truncated to 6 digits
+	for _, vector := range []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		if code := generateTotp(key, time.Unix(vector.time, 0)); code != vector.code {
+			t.Errorf("generateTotp: at %d got %s, wanted %s", vector.time, code, vector.code)
+		}
+	}
+
+	if _, err := decodeTotpSecret("not base32!"); err == nil {
+		t.Errorf("decodeTotpSecret should have failed for an invalid secret")
+	}
+}
+
+func TestTotpLogin(t *testing.T) {
+
+	server, _ := fakehe.New(true)
+	defer server.Close()
+
+	domainFilter := common.CreateDomainFilter("", "", []string{"foo.bar"}, nil)
+
+	for _, test := range []struct {
+		name       string
+		totpSecret string
+		success    bool
+	}{
+		{"valid secret", fakehe.TotpSecret, true},
+		{"no secret", "", false},
+		{"wrong secret", "JBSWY3DPEHPK3PXP", false},
+	} {
+		client, err := NewClient(&config.Config{
+			Username:   fakehe.Username,
+			Password:   fakehe.Password,
+			TotpSecret: test.totpSecret,
+			Url:        server.URL,
+		})
+		if err != nil {
+			t.Fatalf("%s: NewClient should not have failed, but got: %s", test.name, err)
+		}
+
+		err = client.DoLogin(context.Background())
+		if !test.success {
+			if err == nil {
+				t.Errorf("%s: DoLogin should have failed", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: DoLogin should not have failed, but got: %s", test.name, err)
+		}
+
+		zones, err := client.GetMatchingZones(context.Background(), domainFilter)
+		if err != nil {
+			t.Fatalf("%s: GetMatchingZones should not have failed, but got: %s", test.name, err)
+		}
+		if zoneData, ok := zones["foo.bar"]; !ok || zoneData.HostedDnsZoneId != "1234" {
+			t.Errorf("%s: unexpected zones after login: %v", test.name, zones)
+		}
+	}
+}
+
+func TestLoginWithoutTotp(t *testing.T) {
+
+	server, _ := fakehe.New(false)
+	defer server.Close()
+
+	// a configured secret is not a problem if HE doesn't ask for the code
+	client, err := NewClient(&config.Config{
+		Username:   fakehe.Username,
+		Password:   fakehe.Password,
+		TotpSecret: fakehe.TotpSecret,
+		Url:        server.URL,
+	})
+	if err != nil {
+		t.Fatalf("NewClient should not have failed, but got: %s", err)
+	}
+	if err := client.DoLogin(context.Background()); err != nil {
+		t.Errorf("DoLogin should not have failed, but got: %s", err)
+	}
+
+	client, _ = NewClient(&config.Config{Username: fakehe.Username, Password: "wrong", Url: server.URL})
+	if err := client.DoLogin(context.Background()); err == nil {
+		t.Errorf("DoLogin should have failed with a wrong password")
+	}
+}
+
+func TestAddDeleteZone(t *testing.T) {
+
+	server, he := fakehe.New(false)
+	defer server.Close()
+
+	client, err := NewClient(&config.Config{Username: fakehe.Username, Password: fakehe.Password, Url: server.URL})
+	if err != nil {
+		t.Fatalf("NewClient should not have failed, but got: %s", err)
+	}
+	if err := client.DoLogin(context.Background()); err != nil {
+		t.Fatalf("DoLogin should not have failed, but got: %s", err)
+	}
+
+	domainFilter := common.CreateDomainFilter("", "", []string{}, nil)
+
+	if err := client.AddZone(context.Background(), "new.example"); err != nil {
+		t.Fatalf("AddZone should not have failed, but got: %s", err)
+	}
+	// visible in the same session, without logging in again
+	zones, err := client.GetMatchingZones(context.Background(), domainFilter)
+	if err != nil {
+		t.Fatalf("GetMatchingZones should not have failed, but got: %s", err)
+	}
+	zoneData, ok := zones["new.example"]
+	if !ok || zoneData.HostedDnsZoneId != fmt.Sprintf("%d", he.ZoneId("new.example")) {
+		t.Fatalf("GetMatchingZones: new zone not found, got %v", zones)
+	}
+
+	if err := client.DeleteZone(context.Background(), "new.example", zoneData); err != nil {
+		t.Fatalf("DeleteZone should not have failed, but got: %s", err)
+	}
+	zones, _ = client.GetMatchingZones(context.Background(), domainFilter)
+	if _, ok := zones["new.example"]; ok {
+		t.Errorf("GetMatchingZones: deleted zone still present")
+	}
+	if _, ok := zones["foo.bar"]; !ok {
+		t.Errorf("GetMatchingZones: other zones should still be present, got %v", zones)
+	}
+
+	// HE silently ignores the deletion of a zone that is not ours
+	if err := client.DeleteZone(context.Background(), "foo.bar", &common.ZoneData{HostedDnsZoneId: "9999"}); err == nil {
+		t.Errorf("DeleteZone should have failed when the zone is still there")
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+
+	server, _ := fakehe.New(false)
+	defer server.Close()
+
+	logins := testutil.ToFloat64(metrics.HeRequests.WithLabelValues(metrics.PageLogin, "200"))
+	failures := testutil.ToFloat64(metrics.LoginFailures)
+
+	client, _ := NewClient(&config.Config{Username: fakehe.Username, Password: "wrong", Url: server.URL})
+	if err := client.DoLogin(context.Background()); err == nil {
+		t.Fatalf("DoLogin should have failed with a wrong password")
+	}
+
+	// the initial page and the form submission
+	if got := testutil.ToFloat64(metrics.HeRequests.WithLabelValues(metrics.PageLogin, "200")) - logins; got != 2 {
+		t.Errorf("got %v login requests, wanted 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.LoginFailures) - failures; got != 1 {
+		t.Errorf("got %v login failures, wanted 1", got)
+	}
+}
+
+func TestParseZoneRecords(t *testing.T) {
+
+	rows := []string{
+		fmt.Sprintf(fakehe.RecordRow, "dns_tr_locked", "1", "foo.bar", "NS", "NS", "172800", "-", "ns1.he.net"),
+		fmt.Sprintf(fakehe.RecordRow, "dns_tr", "2", "foo.bar", "MX", "MX", "3600", "10", "mail.foo.bar"),
+		fmt.Sprintf(fakehe.RecordRow, "dns_tr", "3", "_sip._tcp.foo.bar", "SRV", "SRV", "300", "5", "0 5060 sip.foo.bar"),
+		fmt.Sprintf(fakehe.RecordRow, "dns_tr", "4", "foo.bar", "TXT", "TXT", "300", "-", "&quot;v=spf1 -all&quot;"),
+		fmt.Sprintf(fakehe.RecordRow, "dns_tr", "5", "bad.foo.bar", "A", "A", "x", "-", "1.1.1.1"),
+	}
+	body := `<html><body><div id="dns_main_content"><table>` + strings.Join(rows, "\n") + `</table></div></body></html>`
+
+	endpoints, err := parseZoneRecords("foo.bar", &common.ZoneData{HostedDnsZoneId: "1234"}, body)
+	if err != nil {
+		t.Fatalf("parseZoneRecords should not have failed, but got: %s", err)
+	}
+
+	expected := []string{
+		"foo.bar NS ns1.he.net",
+		"foo.bar MX 10 mail.foo.bar",
+		"_sip._tcp.foo.bar SRV 5 0 5060 sip.foo.bar",
+		`foo.bar TXT "v=spf1 -all"`,
+	}
+	if len(endpoints) != len(expected) {
+		t.Fatalf("parseZoneRecords: got %v, wanted %v", endpoints, expected)
+	}
+	for i, ep := range endpoints {
+		if got := ep.DNSName + " " + ep.RecordType + " " + ep.Targets[0]; got != expected[i] {
+			t.Errorf("parseZoneRecords: got '%s', wanted '%s'", got, expected[i])
+		}
+	}
+	if !common.IsReadOnly(endpoints[0]) || common.IsReadOnly(endpoints[1]) {
+		t.Errorf("parseZoneRecords: only the locked row should be read-only")
+	}
+
+	// and back, for the edit form
+	for _, test := range []struct {
+		recordType string
+		target     string
+		priority   string
+		content    string
+	}{
+		{"MX", "10 mail.foo.bar", "10", "mail.foo.bar"},
+		{"SRV", "5 0 5060 sip.foo.bar", "5", "0 5060 sip.foo.bar"},
+		{"MX", "mail.foo.bar", "", "mail.foo.bar"},
+		{"TXT", "10 green bottles", "", "10 green bottles"},
+	} {
+		priority, content := splitPriority(test.recordType, test.target)
+		if priority != test.priority || content != test.content {
+			t.Errorf("splitPriority(%s, %s): got '%s' '%s', wanted '%s' '%s'", test.recordType, test.target, priority, content, test.priority, test.content)
+		}
+	}
+}
+
+// what we write is what we read back, so external-dns sees no difference
+// and doesn't update the records again at the next sync
+func TestPriorityRoundTrip(t *testing.T) {
+
+	server, he := fakehe.New(false)
+	defer server.Close()
+
+	client, _ := NewClient(&config.Config{Username: fakehe.Username, Password: fakehe.Password, Url: server.URL})
+	if err := client.DoLogin(context.Background()); err != nil {
+		t.Fatalf("DoLogin should not have failed, but got: %s", err)
+	}
+	defer client.DoLogout(context.Background())
+
+	zoneData := &common.ZoneData{TargetLink: "?hosted_dns_zoneid=1234&menu=edit_zone&hosted_dns_editzone", HostedDnsZoneId: "1234"}
+	read := func() map[string]*endpoint.Endpoint {
+		endpoints, err := client.GetZoneEndpoints(context.Background(), "foo.bar", zoneData)
+		if err != nil {
+			t.Fatalf("GetZoneEndpoints should not have failed, but got: %s", err)
+		}
+		records := map[string]*endpoint.Endpoint{}
+		for _, ep := range common.ExpandRecords(endpoints) {
+			records[ep.RecordType] = ep
+		}
+		return records
+	}
+
+	created := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.bar", "MX", "10 mail.foo.bar"),
+		endpoint.NewEndpoint("_sip._tcp.foo.bar", "SRV", "5 0 5060 sip.foo.bar"),
+	}
+	if err := client.CreateRecords(context.Background(), "foo.bar", zoneData, created); err != nil {
+		t.Fatalf("CreateRecords should not have failed, but got: %s", err)
+	}
+
+	// HE has the priority in its own field
+	for _, record := range he.Records(1234) {
+		if (record.Type == "MX" && (record.Priority != "10" || record.Content != "mail.foo.bar")) ||
+			(record.Type == "SRV" && (record.Priority != "5" || record.Content != "0 5060 sip.foo.bar")) {
+			t.Errorf("CreateRecords: HE got priority '%s' and content '%s' for %s", record.Priority, record.Content, record.Type)
+		}
+	}
+
+	records := read()
+	for _, ep := range created {
+		if got := records[ep.RecordType]; got == nil || got.DNSName != ep.DNSName || got.Targets[0] != ep.Targets[0] {
+			t.Errorf("GetZoneEndpoints: got %v, wanted %v", got, ep)
+		}
+	}
+
+	// updates carry the record ID of what we read
+	updated := []*endpoint.Endpoint{}
+	for recordType, target := range map[string]string{"MX": "20 mx2.foo.bar", "SRV": "10 5 5061 sip2.foo.bar"} {
+		recordId, _ := records[recordType].GetProviderSpecificProperty(common.RecordIdTag)
+		ep := endpoint.NewEndpoint(records[recordType].DNSName, recordType, target).WithProviderSpecific(common.RecordIdTag, recordId)
+		updated = append(updated, ep)
+	}
+	if err := client.UpdateRecords(context.Background(), "foo.bar", zoneData, updated); err != nil {
+		t.Fatalf("UpdateRecords should not have failed, but got: %s", err)
+	}
+	records = read()
+	for _, ep := range updated {
+		if got := records[ep.RecordType]; got == nil || got.Targets[0] != ep.Targets[0] {
+			t.Errorf("GetZoneEndpoints after update: got %v, wanted %v", got, ep)
+		}
+	}
+
+	// deletions without the record ID find the records by their target
+	deleted := []*endpoint.Endpoint{}
+	for _, ep := range updated {
+		deleted = append(deleted, endpoint.NewEndpoint(ep.DNSName, ep.RecordType, ep.Targets[0]))
+	}
+	if err := client.DeleteRecords(context.Background(), "foo.bar", zoneData, deleted); err != nil {
+		t.Fatalf("DeleteRecords should not have failed, but got: %s", err)
+	}
+	if records = read(); len(records) != 0 {
+		t.Errorf("DeleteRecords: records left: %v", records)
+	}
+}
+
+func TestDeleteStaleRecordId(t *testing.T) {
+
+	server, he := fakehe.New(false)
+	defer server.Close()
+
+	client, _ := NewClient(&config.Config{Username: fakehe.Username, Password: fakehe.Password, Url: server.URL})
+	if err := client.DoLogin(context.Background()); err != nil {
+		t.Fatalf("DoLogin should not have failed, but got: %s", err)
+	}
+	defer client.DoLogout(context.Background())
+
+	zoneData := &common.ZoneData{TargetLink: "?hosted_dns_zoneid=1234&menu=edit_zone&hosted_dns_editzone", HostedDnsZoneId: "1234"}
+	created := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.foo.bar", "A", "1.1.1.1"),
+		endpoint.NewEndpoint("b.foo.bar", "A", "2.2.2.2"),
+		endpoint.NewEndpoint("c.foo.bar", "A", "3.3.3.3"),
+	}
+	if err := client.CreateRecords(context.Background(), "foo.bar", zoneData, created); err != nil {
+		t.Fatalf("CreateRecords should not have failed, but got: %s", err)
+	}
+	ids := map[string]string{}
+	for _, record := range he.Records(1234) {
+		ids[record.Name] = strconv.Itoa(record.Id)
+	}
+
+	// a.foo.bar carries the ID of b.foo.bar, and the ID of c.foo.bar comes
+	// with a target c.foo.bar doesn't have: a.foo.bar is deleted by its
+	// actual ID, and nothing else
+	deleted := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.foo.bar", "A", "1.1.1.1").WithProviderSpecific(common.RecordIdTag, ids["b.foo.bar"]),
+		endpoint.NewEndpoint("c.foo.bar", "A", "9.9.9.9").WithProviderSpecific(common.RecordIdTag, ids["c.foo.bar"]),
+	}
+	if err := client.DeleteRecords(context.Background(), "foo.bar", zoneData, deleted); err != nil {
+		t.Fatalf("DeleteRecords should not have failed, but got: %s", err)
+	}
+	left := []string{}
+	for _, record := range he.Records(1234) {
+		left = append(left, record.Name)
+	}
+	if !reflect.DeepEqual(left, []string{"b.foo.bar", "c.foo.bar"}) {
+		t.Errorf("DeleteRecords: got records %v left, wanted b.foo.bar and c.foo.bar", left)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+
+	// HE is down until told otherwise
+	var mutex sync.Mutex
+	down := true
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	client, _ := NewClient(&config.Config{Username: fakehe.Username, Password: fakehe.Password, Url: server.URL, BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	now := time.Now()
+	client.breaker.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := client.getPage(ctx, metrics.PageLogin, server.URL); err != nil {
+			t.Fatalf("getPage should have reached HE, got: %s", err)
+		}
+	}
+	if state, failures, _ := client.CircuitBreakerState(); state != BreakerOpen || failures != 2 {
+		t.Fatalf("circuit breaker: got state %s after %d failures, wanted open after 2", state, failures)
+	}
+
+	// HE is not contacted while the breaker is open
+	if err := client.DoLogin(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("DoLogin should have failed with the breaker open, got: %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("circuit breaker: got %d requests to HE, wanted 2", requests)
+	}
+
+	// after the cooldown one request goes through, and if it fails the breaker opens again
+	now = now.Add(time.Minute)
+	if _, _, err := client.getPage(ctx, metrics.PageLogin, server.URL); err != nil {
+		t.Errorf("getPage should have reached HE, got: %s", err)
+	}
+	if state, _, openedAt := client.CircuitBreakerState(); state != BreakerOpen || !openedAt.Equal(now) {
+		t.Errorf("circuit breaker: got state %s opened at %s, wanted open at %s", state, openedAt, now)
+	}
+	if _, _, err := client.getPage(ctx, metrics.PageLogin, server.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("getPage should have failed with the breaker open, got: %v", err)
+	}
+
+	// if it succeeds, it closes
+	now = now.Add(time.Minute)
+	mutex.Lock()
+	down = false
+	mutex.Unlock()
+	if _, _, err := client.getPage(ctx, metrics.PageLogin, server.URL); err != nil {
+		t.Errorf("getPage should have reached HE, got: %s", err)
+	}
+	if state, failures, _ := client.CircuitBreakerState(); state != BreakerClosed || failures != 0 {
+		t.Errorf("circuit breaker: got state %s with %d failures, wanted closed", state, failures)
+	}
+	if requests != 4 {
+		t.Errorf("circuit breaker: got %d requests to HE, wanted 4", requests)
+	}
+}
+
+func TestCircuitBreakerLateRequests(t *testing.T) {
+
+	breaker := newCircuitBreaker(2, time.Minute)
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	// two slow requests are let through while closed, then two others fail
+	late1, _ := breaker.allow()
+	late2, _ := breaker.allow()
+	for i := 0; i < 2; i++ {
+		probe, _ := breaker.allow()
+		breaker.record(probe, outcomeFailure)
+	}
+	if state, _, _ := breaker.State(); state != BreakerOpen {
+		t.Fatalf("circuit breaker: got state %s, wanted open", state)
+	}
+
+	// after the cooldown, one request probes HE
+	now = now.Add(time.Minute)
+	probe, err := breaker.allow()
+	if err != nil || !probe {
+		t.Fatalf("circuit breaker: the first request after the cooldown should be the probe, got %t, %v", probe, err)
+	}
+
+	// the slow requests finishing now don't decide anything, nor end the probe
+	breaker.record(late1, outcomeSuccess)
+	breaker.record(late2, outcomeFailure)
+	if state, _, _ := breaker.State(); state != BreakerHalfOpen {
+		t.Errorf("circuit breaker: got state %s after late requests finished, wanted half-open", state)
+	}
+	if _, err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("circuit breaker: a second request should not go through while probing, got: %v", err)
+	}
+
+	breaker.record(probe, outcomeSuccess)
+	if state, failures, _ := breaker.State(); state != BreakerClosed || failures != 0 {
+		t.Errorf("circuit breaker: got state %s with %d failures after the probe succeeded, wanted closed", state, failures)
+	}
+}
@@ -1,60 +1,138 @@
 package client
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/audit"
 	"github.com/waldner/external-dns-webhook-he/pkg/common"
 	"github.com/waldner/external-dns-webhook-he/pkg/config"
 	"sigs.k8s.io/external-dns/endpoint"
 )
 
 type MockClient struct {
-	config         *config.Config
+	config *config.Config
+	// the zones in the account, initially those in the test data
 	zoneInfo       map[string]*common.ZoneInfo
 	failMap        map[string]bool
 	CreatedRecords []*endpoint.Endpoint
 	DeletedRecords []*endpoint.Endpoint
+	UpdatedRecords []*endpoint.Endpoint
+	// number of calls to each method
+	Calls map[string]int
+	// number of requests HEClient would have sent to HE
+	requests uint64
+	// the zones whose page was loaded in the current session
+	zonePages map[string]bool
+	// how long GetZoneEndpoints takes, and how many calls to it have
+	// been running at the same time at most
+	ZoneDelay    time.Duration
+	zoneReads    int
+	MaxZoneReads int
+	// like HEClient, record operations are written here if configured
+	auditLog *audit.Logger
+	mutex    sync.Mutex
 }
 
 func NewMockClient(config *config.Config) *MockClient {
 
+	zoneInfo := map[string]*common.ZoneInfo{}
+	for zone, info := range common.TestData {
+		zoneInfo[zone] = info
+	}
+
+	auditLog, err := audit.NewLogger(config.AuditLog, config.AuditLogMaxSize, config.AuditLogMaxFiles)
+	if err != nil {
+		log.Errorf("NewMockClient: %s", err)
+	}
+
 	return &MockClient{
+		auditLog:       auditLog,
 		config:         config,
+		zoneInfo:       zoneInfo,
 		CreatedRecords: []*endpoint.Endpoint{},
 		DeletedRecords: []*endpoint.Endpoint{},
+		UpdatedRecords: []*endpoint.Endpoint{},
+		Calls:          map[string]int{},
+		zonePages:      map[string]bool{},
 	}
 }
 
-func (c *MockClient) SetFailure(failure string) {
+// each failure is either a method name, which makes every call to that method
+// fail, or "<method>:<dns name>", which only makes operations on that record
+// (or zone, for GetZoneEndpoints) fail
+func (c *MockClient) SetFailure(failures ...string) {
 	c.failMap = map[string]bool{}
-	if failure != "" {
-		c.failMap[failure] = true
+	for _, failure := range failures {
+		if failure != "" {
+			c.failMap[failure] = true
+		}
 	}
 }
 
-func (c *MockClient) DoLogin() error {
+func (c *MockClient) RequestCount() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.requests
+}
+
+// the mock client is never rate limited
+func (c *MockClient) RateLimiterState() (float64, float64) {
+	return 0, 0
+}
+
+// and its circuit breaker never opens
+func (c *MockClient) CircuitBreakerState() (string, int, time.Time) {
+	return BreakerClosed, 0, time.Time{}
+}
+
+func (c *MockClient) DoLogin(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Calls["DoLogin"]++
 	if c.failMap["DoLogin"] {
 		return fmt.Errorf("DoLogin error")
 	}
+	// initial page + login form
+	c.requests += 2
+	c.zonePages = map[string]bool{}
 	return nil
 }
-func (c *MockClient) DoLogout() error {
+
+// there's no session to wait for
+func (c *MockClient) TryLogin(ctx context.Context) (bool, error) {
+	return true, c.DoLogin(ctx)
+}
+
+func (c *MockClient) DoLogout(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Calls["DoLogout"]++
 	if c.failMap["DoLogout"] {
 		return fmt.Errorf("DoLogout error")
 	}
+	c.requests++
 	return nil
 }
 
-func (c *MockClient) GetMatchingZones(domainFilter *endpoint.DomainFilter) (map[string]*common.ZoneData, error) {
+func (c *MockClient) GetMatchingZones(ctx context.Context, domainFilter *endpoint.DomainFilter) (map[string]*common.ZoneData, error) {
 
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Calls["GetMatchingZones"]++
 	if c.failMap["GetMatchingZones"] {
 		return nil, fmt.Errorf("GetMatchingZones error")
 	}
 
 	zones := map[string]*common.ZoneData{}
 
-	for zone, zoneInfo := range common.TestData {
+	for zone, zoneInfo := range c.zoneInfo {
 		if domainFilter.Match(zone) {
 			zones[zone] = zoneInfo.ZoneData
 		}
@@ -63,42 +141,168 @@ func (c *MockClient) GetMatchingZones(domainFilter *endpoint.DomainFilter) (map[
 	return zones, nil
 }
 
-func (c *MockClient) GetZoneEndpoints(zone string, zoneData *common.ZoneData) ([]*endpoint.Endpoint, error) {
+func (c *MockClient) GetZoneEndpoints(ctx context.Context, zone string, zoneData *common.ZoneData) ([]*endpoint.Endpoint, error) {
+
+	c.mutex.Lock()
+	c.Calls["GetZoneEndpoints"]++
+	c.zoneReads++
+	c.MaxZoneReads = max(c.MaxZoneReads, c.zoneReads)
+	c.mutex.Unlock()
+
+	// pretend we're waiting for HE
+	select {
+	case <-time.After(c.ZoneDelay):
+	case <-ctx.Done():
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	if c.failMap["GetZoneEndpoints"] {
+	c.zoneReads--
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("GetZoneEndpoints: %s", err)
+	}
+	if c.failMap["GetZoneEndpoints"] || c.failMap["GetZoneEndpoints:"+zone] {
 		return nil, fmt.Errorf("GetZoneEndpoint error")
 	}
 
-	if _, ok := common.TestData[zone]; !ok {
+	c.requests++
+	if _, ok := c.zoneInfo[zone]; !ok {
 		return nil, fmt.Errorf("Zone %s not found", zone)
 	}
+	c.zonePages[zone] = true
+
+	return common.AggregateRecords(c.zoneInfo[zone].Endpoints), nil
+}
+
+func (c *MockClient) AddZone(ctx context.Context, zone string) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Calls["AddZone"]++
+	if c.failMap["AddZone"] || c.failMap["AddZone:"+zone] {
+		return fmt.Errorf("AddZone error")
+	}
+	// add form + zone list
+	c.requests += 2
+	c.zoneInfo[zone] = &common.ZoneInfo{
+		ZoneData:  &common.ZoneData{HostedDnsZoneId: fmt.Sprintf("%d", 2000+len(c.zoneInfo))},
+		Endpoints: []*endpoint.Endpoint{},
+	}
+	return nil
+}
 
-	return common.ExpandRecords(common.TestData[zone].Endpoints), nil
+func (c *MockClient) DeleteZone(ctx context.Context, zone string, zoneData *common.ZoneData) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Calls["DeleteZone"]++
+	if c.failMap["DeleteZone"] || c.failMap["DeleteZone:"+zone] {
+		return fmt.Errorf("DeleteZone error")
+	}
+	// delete form + zone list
+	c.requests += 2
+	delete(c.zoneInfo, zone)
+	return nil
 }
 
-func (c *MockClient) CreateRecords(zone string, zoneData *common.ZoneData, records []*endpoint.Endpoint) error {
+func (c *MockClient) CreateRecords(ctx context.Context, zone string, zoneData *common.ZoneData, records []*endpoint.Endpoint) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
+	c.Calls["CreateRecords"]++
 	if c.failMap["CreateRecords"] {
 		return fmt.Errorf("CreateRecords error")
 	}
 
 	//log.Infof("Must create records: %+v", records)
 	for _, record := range common.ExpandRecords(records) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("CreateRecords: %s", err)
+		}
+		if c.failMap["CreateRecords:"+record.DNSName] {
+			err := fmt.Errorf("CreateRecords error for record %s", record)
+			c.auditLog.Log(auditEntry(ctx, audit.ActionCreate, zone, record, "", "", err))
+			return err
+		}
 		log.Infof("Creating record %s", record)
+		c.auditLog.Log(auditEntry(ctx, audit.ActionCreate, zone, record, "", "", nil))
+		c.requests++
 		c.CreatedRecords = append(c.CreatedRecords, record)
 	}
 	return nil
 }
 
-func (c *MockClient) DeleteRecords(zone string, zoneData *common.ZoneData, records []*endpoint.Endpoint) error {
+func (c *MockClient) DeleteRecords(ctx context.Context, zone string, zoneData *common.ZoneData, records []*endpoint.Endpoint) error {
 
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Calls["DeleteRecords"]++
 	if c.failMap["DeleteRecords"] {
 		return fmt.Errorf("DeleteRecords error")
 	}
-	for _, record := range common.ExpandRecords(records) {
+
+	records = common.ExpandRecords(records)
+	// like HEClient, load the zone page to check the IDs, unless it was
+	// already seen in this session
+	if !c.zonePages[zone] {
+		c.zonePages[zone] = true
+		c.requests++
+	}
+
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("DeleteRecords: %s", err)
+		}
+		recordId, _ := record.GetProviderSpecificProperty(common.RecordIdTag)
+		if c.failMap["DeleteRecords:"+record.DNSName] {
+			err := fmt.Errorf("DeleteRecords error for record %s", record)
+			c.auditLog.Log(auditEntry(ctx, audit.ActionDelete, zone, record, recordId, "", err))
+			return err
+		}
 		log.Infof("Deleting record %s", record)
+		c.auditLog.Log(auditEntry(ctx, audit.ActionDelete, zone, record, recordId, "", nil))
+		c.requests++
 		c.DeletedRecords = append(c.DeletedRecords, record)
 	}
 
 	return nil
 }
+
+func (c *MockClient) UpdateRecords(ctx context.Context, zone string, zoneData *common.ZoneData, records []*endpoint.Endpoint) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Calls["UpdateRecords"]++
+	if c.failMap["UpdateRecords"] {
+		return fmt.Errorf("UpdateRecords error")
+	}
+
+	for _, ep := range records {
+		previous, _ := ep.GetProviderSpecificProperty(common.PreviousTargetTag)
+		for _, record := range common.ExpandRecords([]*endpoint.Endpoint{ep}) {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("UpdateRecords: %s", err)
+			}
+			recordId, _ := record.GetProviderSpecificProperty(common.RecordIdTag)
+			if c.failMap["UpdateRecords:"+record.DNSName] {
+				err := fmt.Errorf("UpdateRecords error for record %s", record)
+				c.auditLog.Log(auditEntry(ctx, audit.ActionUpdate, zone, record, recordId, previous, err))
+				return err
+			}
+			if recordId == "" {
+				return fmt.Errorf("UpdateRecords: record %s has no record ID", record)
+			}
+			log.Infof("Updating record %s", record)
+			c.auditLog.Log(auditEntry(ctx, audit.ActionUpdate, zone, record, recordId, previous, nil))
+			c.requests++
+			c.UpdatedRecords = append(c.UpdatedRecords, record)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/config"
+)
+
+// build the transport used to talk to HE, with the configured
+// timeouts, proxy and TLS settings
+func newTransport(config *config.Config) (*http.Transport, error) {
+
+	dialer := &net.Dialer{
+		Timeout:   config.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = config.ConnectTimeout
+	transport.ResponseHeaderTimeout = config.ResponseTimeout
+
+	// socks5 proxies are supported directly by the transport
+	if config.ProxyUrl != "" {
+		proxyUrl, err := url.Parse(config.ProxyUrl)
+		if err != nil {
+			return nil, fmt.Errorf("newTransport: invalid proxy URL: %s", err)
+		}
+		log.Infof("Using proxy %s", proxyUrl.Redacted())
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("newTransport: %s", err)
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return transport, nil
+}
+
+func newTLSConfig(config *config.Config) (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// additional CAs are trusted on top of the system ones, eg
+	// for a TLS-intercepting proxy
+	if config.CaFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			log.Warnf("Cannot load system CA pool, only trusting '%s': %s", config.CaFile, err)
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(config.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("newTLSConfig: reading CA file: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("newTLSConfig: no valid certificate found in CA file '%s'", config.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("newTLSConfig: loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -4,12 +4,31 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"strings"
 
 	"sigs.k8s.io/external-dns/endpoint"
 )
 
 // "github.com/go-test/deep"
 
+// provider-specific property holding the HE record IDs of an endpoint,
+// comma-separated and in the same order as its targets
+const RecordIdTag = "edns.xdb.me/he-record-id"
+
+// provider-specific property set to "true" on records that HE doesn't let
+// us change (the locked rows of the zone page, eg the SOA and NS records)
+const ReadOnlyTag = "edns.xdb.me/he-read-only"
+
+// provider-specific property carrying, on a record that overwrites an
+// existing one, the target it replaces. Only used for the audit log
+const PreviousTargetTag = "edns.xdb.me/he-previous-target"
+
+// check whether the endpoint is marked as read-only
+func IsReadOnly(ep *endpoint.Endpoint) bool {
+	value, _ := ep.GetProviderSpecificProperty(ReadOnlyTag)
+	return value == "true"
+}
+
 type ZoneData struct {
 	TargetLink      string
 	HostedDnsZoneId string
@@ -40,14 +59,23 @@ func CreateDomainFilter(regexDomainFilter string, regexDomainExclude string, lis
 
 }
 
+// split endpoints into single-target records, each one carrying
+// the HE record ID of its target, if known, and the read-only flag
 func ExpandRecords(eps []*endpoint.Endpoint) []*endpoint.Endpoint {
 
 	//log.Infof("Must expand: %+v", eps)
 
 	records := []*endpoint.Endpoint{}
 	for _, ep := range eps {
-		for _, target := range ep.Targets {
+		recordIds := GetRecordIds(ep)
+		for i, target := range ep.Targets {
 			record := endpoint.NewEndpointWithTTL(ep.DNSName, ep.RecordType, ep.RecordTTL, target)
+			if recordIds != nil && recordIds[i] != "" {
+				record = record.WithProviderSpecific(RecordIdTag, recordIds[i])
+			}
+			if IsReadOnly(ep) {
+				record = record.WithProviderSpecific(ReadOnlyTag, "true")
+			}
 			records = append(records, record)
 		}
 	}
@@ -55,6 +83,62 @@ func ExpandRecords(eps []*endpoint.Endpoint) []*endpoint.Endpoint {
 	return records
 }
 
+// the opposite of ExpandRecords: group records with the same name, type, TTL and
+// read-only flag into a single endpoint with multiple targets, keeping all their record IDs
+func AggregateRecords(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+
+	eps := []*endpoint.Endpoint{}
+	recordIds := map[*endpoint.Endpoint][]string{}
+
+	for _, record := range ExpandRecords(records) {
+		var ep *endpoint.Endpoint
+		for _, e := range eps {
+			if e.DNSName == record.DNSName && e.RecordType == record.RecordType && e.RecordTTL == record.RecordTTL && IsReadOnly(e) == IsReadOnly(record) {
+				ep = e
+				break
+			}
+		}
+		if ep == nil {
+			ep = endpoint.NewEndpointWithTTL(record.DNSName, record.RecordType, record.RecordTTL)
+			if IsReadOnly(record) {
+				ep.SetProviderSpecificProperty(ReadOnlyTag, "true")
+			}
+			eps = append(eps, ep)
+		}
+		recordId, _ := record.GetProviderSpecificProperty(RecordIdTag)
+		ep.Targets = append(ep.Targets, record.Targets[0])
+		recordIds[ep] = append(recordIds[ep], recordId)
+	}
+
+	for _, ep := range eps {
+		SetRecordIds(ep, recordIds[ep])
+	}
+	return eps
+}
+
+// return the HE record IDs of the endpoint, one per target (empty if unknown),
+// or nil if they cannot be determined
+func GetRecordIds(ep *endpoint.Endpoint) []string {
+	value, ok := ep.GetProviderSpecificProperty(RecordIdTag)
+	if !ok || value == "" {
+		return nil
+	}
+	recordIds := strings.Split(value, ",")
+	if len(recordIds) != len(ep.Targets) {
+		return nil
+	}
+	return recordIds
+}
+
+// set the HE record IDs of the endpoint, which must be as many as its targets
+func SetRecordIds(ep *endpoint.Endpoint, recordIds []string) {
+	if strings.Join(recordIds, "") == "" {
+		ep.DeleteProviderSpecificProperty(RecordIdTag)
+		return
+	}
+	ep.SetProviderSpecificProperty(RecordIdTag, strings.Join(recordIds, ","))
+}
+
 // compare two lists of endpoints
 func SameEndpoints(eps1 []*endpoint.Endpoint, eps2 []*endpoint.Endpoint) bool {
 
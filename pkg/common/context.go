@@ -0,0 +1,55 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+type contextKey string
+
+const (
+	requestIdsKey contextKey = "requestIds"
+	batchIdKey    contextKey = "batchId"
+)
+
+// return a random hex string, to be used as an ID
+func NewId() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// return a new batch ID. They sort in time order
+func NewBatchId() string {
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + NewId()
+}
+
+// add the ID of a request that the operations in the context are done for.
+// A batch of changes can come from several requests
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	requestIds := append(append([]string{}, RequestIds(ctx)...), requestId)
+	return context.WithValue(ctx, requestIdsKey, requestIds)
+}
+
+// set the IDs of the requests that the operations in the context are done
+// for, replacing those already there
+func WithRequestIds(ctx context.Context, requestIds []string) context.Context {
+	return context.WithValue(ctx, requestIdsKey, append([]string{}, requestIds...))
+}
+
+func RequestIds(ctx context.Context) []string {
+	requestIds, _ := ctx.Value(requestIdsKey).([]string)
+	return requestIds
+}
+
+// set the ID of the batch of changes the operations in the context belong to
+func WithBatchId(ctx context.Context, batchId string) context.Context {
+	return context.WithValue(ctx, batchIdKey, batchId)
+}
+
+func BatchId(ctx context.Context) string {
+	batchId, _ := ctx.Value(batchIdKey).(string)
+	return batchId
+}
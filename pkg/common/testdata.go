@@ -5,28 +5,32 @@ import (
 	"sigs.k8s.io/external-dns/plan"
 )
 
+// like HE rows, each endpoint has a single target and its own record ID
 var TestData map[string]*ZoneInfo = map[string]*ZoneInfo{
 	"foo.bar": &ZoneInfo{
 		ZoneData: &ZoneData{}, // not used by the mock client
 		Endpoints: []*endpoint.Endpoint{
-			endpoint.NewEndpoint("a.foo.bar", "A", "1.1.1.1"),
-			endpoint.NewEndpoint("b.foo.bar", "A", "1.1.1.3"),
-			endpoint.NewEndpoint("z.foo.bar", "A", "1.1.1.4"),
-			endpoint.NewEndpoint("z.foo.bar", "TXT", "foobar"),
+			endpoint.NewEndpoint("a.foo.bar", "A", "1.1.1.1").WithProviderSpecific(RecordIdTag, "1001"),
+			endpoint.NewEndpoint("b.foo.bar", "A", "1.1.1.3").WithProviderSpecific(RecordIdTag, "1002"),
+			endpoint.NewEndpoint("z.foo.bar", "A", "1.1.1.4").WithProviderSpecific(RecordIdTag, "1003"),
+			endpoint.NewEndpoint("z.foo.bar", "TXT", "foobar").WithProviderSpecific(RecordIdTag, "1004"),
 		}},
 	"foo.baz": &ZoneInfo{
 		ZoneData: &ZoneData{},
 		Endpoints: []*endpoint.Endpoint{
-			endpoint.NewEndpoint("n1.foo.baz", "A", "192.168.1.1"),
-			endpoint.NewEndpoint("hello.foo.baz", "A", "192.168.1.3"),
-			endpoint.NewEndpoint("foo.baz", "A", "192.168.1.4"),
+			endpoint.NewEndpoint("n1.foo.baz", "A", "192.168.1.1").WithProviderSpecific(RecordIdTag, "1005"),
+			endpoint.NewEndpoint("hello.foo.baz", "A", "192.168.1.3").WithProviderSpecific(RecordIdTag, "1006"),
+			endpoint.NewEndpoint("foo.baz", "A", "192.168.1.4").WithProviderSpecific(RecordIdTag, "1007"),
+			// locked rows, managed by HE
+			endpoint.NewEndpointWithTTL("foo.baz", "NS", 172800, "ns1.he.net").WithProviderSpecific(RecordIdTag, "1011").WithProviderSpecific(ReadOnlyTag, "true"),
+			endpoint.NewEndpointWithTTL("foo.baz", "NS", 172800, "ns2.he.net").WithProviderSpecific(RecordIdTag, "1012").WithProviderSpecific(ReadOnlyTag, "true"),
 		}},
 	"foo.zzz": &ZoneInfo{
 		ZoneData: &ZoneData{},
 		Endpoints: []*endpoint.Endpoint{
-			endpoint.NewEndpoint("single.foo.zzz", "A", "172.16.100.199"),
-			endpoint.NewEndpoint("single.foo.zzz", "A", "172.16.100.200"),
-			endpoint.NewEndpoint("bbb.foo.zzz", "A", "172.17.100.199"),
+			endpoint.NewEndpoint("single.foo.zzz", "A", "172.16.100.199").WithProviderSpecific(RecordIdTag, "1008"),
+			endpoint.NewEndpoint("single.foo.zzz", "A", "172.16.100.200").WithProviderSpecific(RecordIdTag, "1009"),
+			endpoint.NewEndpoint("bbb.foo.zzz", "A", "172.17.100.199").WithProviderSpecific(RecordIdTag, "1010"),
 		},
 	},
 }
@@ -38,6 +42,10 @@ type TestCase struct {
 	ExcludeRegex         string
 	AdjustEndpointsInput []*endpoint.Endpoint
 	ApplyChangesInput    *plan.Changes
+	// what's actually sent to HE after the changes are optimized
+	ApplyChangesCreated []*endpoint.Endpoint
+	ApplyChangesDeleted []*endpoint.Endpoint
+	ApplyChangesUpdated []*endpoint.Endpoint
 }
 
 var TestCases []*TestCase = []*TestCase{
@@ -58,6 +66,14 @@ var TestCases []*TestCase = []*TestCase{
 				endpoint.NewEndpointWithTTL("update.foo.baz", "A", 1500, "3.3.3.3", "5.5.5.5"),
 			},
 		},
+		// aaa.foo.bar and update.foo.baz don't exist, so there's nothing to delete
+		ApplyChangesCreated: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("aaa.foo.bar", "A", "10.1.1.1"),
+			endpoint.NewEndpointWithTTL("update.foo.baz", "A", 1500, "3.3.3.3"),
+			endpoint.NewEndpointWithTTL("update.foo.baz", "A", 1500, "5.5.5.5"),
+		},
+		ApplyChangesDeleted: []*endpoint.Endpoint{},
+		ApplyChangesUpdated: []*endpoint.Endpoint{},
 	},
 	&TestCase{
 		IncludeList:          []string{"foo.zzz"},
@@ -71,10 +87,20 @@ var TestCases []*TestCase = []*TestCase{
 			},
 			UpdateOld: []*endpoint.Endpoint{
 				endpoint.NewEndpointWithTTL("single.foo.zzz", "A", 500, "172.16.100.199", "172.16.100.200"),
+				endpoint.NewEndpoint("bbb.foo.zzz", "A", "172.17.100.199"),
 			},
 			UpdateNew: []*endpoint.Endpoint{
 				endpoint.NewEndpointWithTTL("single.foo.zzz", "A", 1500, "172.16.100.199", "172.16.100.200"),
+				endpoint.NewEndpoint("bbb.foo.zzz", "A", "172.17.100.200"),
 			},
 		},
+		// bbb.foo.zzz 10.1.1.1 doesn't exist, and the single.foo.zzz records stay the same
+		ApplyChangesCreated: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("aaa.foo.zzz", "A", "10.1.1.1"),
+		},
+		ApplyChangesDeleted: []*endpoint.Endpoint{},
+		ApplyChangesUpdated: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("bbb.foo.zzz", "A", "172.17.100.200").WithProviderSpecific(RecordIdTag, "1010"),
+		},
 	},
 }
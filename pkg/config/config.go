@@ -2,7 +2,11 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v8"
 	log "github.com/sirupsen/logrus"
@@ -10,20 +14,122 @@ import (
 	"sigs.k8s.io/external-dns/endpoint"
 )
 
+// we don't want to hammer HE with too many requests at the same time
+const maxZoneConcurrency = 8
+
 type envConfig struct {
-	Username            string   `env:"WEBHOOK_HE_USERNAME" envDefault:""`
-	Password            string   `env:"WEBHOOK_HE_PASSWORD" envDefault:""`
-	Url                 string   `env:"WEBHOOK_HE_URL" envDefault:"https://dns.he.net"`
-	DomainFilter        []string `env:"WEBHOOK_HE_DOMAIN_FILTER" envDefault:""`
-	DomainFilterExclude []string `env:"WEBHOOK_HE_DOMAIN_FILTER_EXCLUDE" envDefault:""`
-	RegexDomainFilter   string   `env:"WEBHOOK_HE_REGEXP_DOMAIN_FILTER" envDefault:""`
-	RegexDomainExclude  string   `env:"WEBHOOK_HE_REGEXP_DOMAIN_FILTER_EXCLUDE" envDefault:""`
+	Username             string        `env:"WEBHOOK_HE_USERNAME" envDefault:""`
+	Password             string        `env:"WEBHOOK_HE_PASSWORD" envDefault:""`
+	TotpSecret           string        `env:"WEBHOOK_HE_TOTP_SECRET" envDefault:""`
+	Url                  string        `env:"WEBHOOK_HE_URL" envDefault:"https://dns.he.net"`
+	DomainFilter         []string      `env:"WEBHOOK_HE_DOMAIN_FILTER" envDefault:""`
+	DomainFilterExclude  []string      `env:"WEBHOOK_HE_DOMAIN_FILTER_EXCLUDE" envDefault:""`
+	RegexDomainFilter    string        `env:"WEBHOOK_HE_REGEXP_DOMAIN_FILTER" envDefault:""`
+	RegexDomainExclude   string        `env:"WEBHOOK_HE_REGEXP_DOMAIN_FILTER_EXCLUDE" envDefault:""`
+	Transactional        bool          `env:"WEBHOOK_HE_TRANSACTIONAL" envDefault:"false"`
+	StrictRecords        bool          `env:"WEBHOOK_HE_STRICT_RECORDS" envDefault:"false"`
+	ExcludeReadOnly      bool          `env:"WEBHOOK_HE_EXCLUDE_READ_ONLY" envDefault:"false"`
+	AllowZoneDeletion    bool          `env:"WEBHOOK_HE_ALLOW_ZONE_DELETION" envDefault:"false"`
+	ZoneConcurrency      int           `env:"WEBHOOK_HE_ZONE_CONCURRENCY" envDefault:"1"`
+	MaxRequestsPerSecond float64       `env:"WEBHOOK_HE_MAX_REQUESTS_PER_SECOND" envDefault:"0"`
+	CacheTTL             time.Duration `env:"WEBHOOK_HE_CACHE_TTL" envDefault:"0s"`
+	BatchWindow          time.Duration `env:"WEBHOOK_HE_BATCH_WINDOW" envDefault:"0s"`
+	RequestTimeout       time.Duration `env:"WEBHOOK_HE_REQUEST_TIMEOUT" envDefault:"30s"`
+	OperationTimeout     time.Duration `env:"WEBHOOK_HE_OPERATION_TIMEOUT" envDefault:"5m"`
+	ConnectTimeout       time.Duration `env:"WEBHOOK_HE_CONNECT_TIMEOUT" envDefault:"10s"`
+	ResponseTimeout      time.Duration `env:"WEBHOOK_HE_RESPONSE_TIMEOUT" envDefault:"30s"`
+	ProxyUrl             string        `env:"WEBHOOK_HE_PROXY_URL" envDefault:""`
+	CaFile               string        `env:"WEBHOOK_HE_CA_FILE" envDefault:""`
+	ClientCertFile       string        `env:"WEBHOOK_HE_CLIENT_CERT_FILE" envDefault:""`
+	ClientKeyFile        string        `env:"WEBHOOK_HE_CLIENT_KEY_FILE" envDefault:""`
+	UserAgent            string        `env:"WEBHOOK_HE_USER_AGENT" envDefault:"external-dns-webhook-he"`
+	ReadinessInterval    time.Duration `env:"WEBHOOK_HE_READINESS_INTERVAL" envDefault:"5m"`
+	AuditLog             string        `env:"WEBHOOK_HE_AUDIT_LOG" envDefault:""`
+	AuditLogMaxSizeMB    int64         `env:"WEBHOOK_HE_AUDIT_LOG_MAX_SIZE_MB" envDefault:"100"`
+	AuditLogMaxFiles     int           `env:"WEBHOOK_HE_AUDIT_LOG_MAX_FILES" envDefault:"10"`
+	SnapshotDir          string        `env:"WEBHOOK_HE_SNAPSHOT_DIR" envDefault:""`
+	SnapshotMaxPerZone   int           `env:"WEBHOOK_HE_SNAPSHOT_MAX_PER_ZONE" envDefault:"50"`
+	SnapshotMaxAge       time.Duration `env:"WEBHOOK_HE_SNAPSHOT_MAX_AGE" envDefault:"0s"`
+	BreakerThreshold     int           `env:"WEBHOOK_HE_BREAKER_THRESHOLD" envDefault:"5"`
+	BreakerCooldown      time.Duration `env:"WEBHOOK_HE_BREAKER_COOLDOWN" envDefault:"30s"`
+	TxtPrefix            string        `env:"WEBHOOK_HE_TXT_PREFIX" envDefault:""`
+	TxtSuffix            string        `env:"WEBHOOK_HE_TXT_SUFFIX" envDefault:""`
+	AdminEnabled         bool          `env:"WEBHOOK_HE_ADMIN_ENABLED" envDefault:"false"`
+	AdminAddress         string        `env:"WEBHOOK_HE_ADMIN_ADDRESS" envDefault:"127.0.0.1:3334"`
+	AdminToken           string        `env:"WEBHOOK_HE_ADMIN_TOKEN" envDefault:""`
 }
 
 type Config struct {
 	Username string
 	Password string
-	Url      string
+	// base32 seed of the 2FA code, if enabled on the account
+	TotpSecret string
+	Url        string
+	// if true, ApplyChanges undoes the operations it already performed
+	// when a later one fails
+	Transactional bool
+	// if true, GetAllRecords fails if any zone cannot be read, instead of
+	// skipping it
+	StrictRecords bool
+	// if true, the records locked by HE (SOA, NS) are not returned
+	ExcludeReadOnly bool
+	// zones can only be deleted if this is true
+	AllowZoneDeletion bool
+	// how many zone pages GetAllRecords can load at the same time
+	ZoneConcurrency int
+	// maximum rate of requests sent to HE, 0 means unlimited
+	MaxRequestsPerSecond float64
+	// how long zone lists and records are cached, 0 disables the cache
+	CacheTTL time.Duration
+	// how long ApplyChanges waits for more changes to apply them together,
+	// 0 applies them right away
+	BatchWindow time.Duration
+	// deadline for each single request sent to HE, 0 means none
+	RequestTimeout time.Duration
+	// deadline for a whole read or change operation, 0 means none
+	OperationTimeout time.Duration
+	// how long to wait for the TCP connection (and TLS handshake) to HE
+	ConnectTimeout time.Duration
+	// how long to wait for the response headers once a request has been sent
+	ResponseTimeout time.Duration
+	// http://, https:// or socks5:// proxy to use, if empty the
+	// standard HTTP_PROXY/HTTPS_PROXY/NO_PROXY variables are honored
+	ProxyUrl string
+	// PEM bundle of additional CAs to trust
+	CaFile string
+	// PEM client certificate and key to present
+	ClientCertFile string
+	ClientKeyFile  string
+	UserAgent      string
+	// how long the result of the readiness check is reused before
+	// checking again, so probes don't cause a login each time
+	ReadinessInterval time.Duration
+	// path of the JSON Lines audit log of the record changes, empty disables it
+	AuditLog string
+	// size in bytes after which the audit log is rotated, 0 means never
+	AuditLogMaxSize int64
+	// how many rotated audit logs are kept
+	AuditLogMaxFiles int
+	// where the zones are saved before being changed, empty disables snapshots
+	SnapshotDir string
+	// how many snapshots are kept for each zone, 0 means no limit
+	SnapshotMaxPerZone int
+	// snapshots older than this are deleted, 0 means never
+	SnapshotMaxAge time.Duration
+	// consecutive failed requests after which HE is not contacted for
+	// the cooldown, 0 disables the circuit breaker
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// the --txt-prefix and --txt-suffix given to external-dns, to find
+	// its registry records
+	TxtPrefix string
+	TxtSuffix string
+	// the admin endpoints (zones, export, cache flush, status) are only
+	// served if enabled, on their own listener
+	AdminEnabled bool
+	AdminAddress string
+	// if set, admin requests must carry it as a bearer token
+	AdminToken string
 }
 
 func NewConfig() (*Config, *endpoint.DomainFilter, error) {
@@ -39,6 +145,44 @@ func NewConfig() (*Config, *endpoint.DomainFilter, error) {
 	if conf.Password == "" {
 		log.Fatal("NewConfig: empty password supplied")
 	}
+	if conf.ZoneConcurrency < 1 || conf.ZoneConcurrency > maxZoneConcurrency {
+		log.Fatalf("NewConfig: zone concurrency must be between 1 and %d", maxZoneConcurrency)
+	}
+	if conf.AuditLogMaxSizeMB < 0 || conf.AuditLogMaxFiles < 1 {
+		log.Fatal("NewConfig: the audit log maximum size can't be negative, and at least one rotated file must be kept")
+	}
+	if conf.SnapshotMaxPerZone < 0 || conf.SnapshotMaxAge < 0 {
+		log.Fatal("NewConfig: the snapshot limits can't be negative")
+	}
+	if conf.BreakerThreshold < 0 || conf.BreakerCooldown < 0 {
+		log.Fatal("NewConfig: the circuit breaker threshold and cooldown can't be negative")
+	}
+	if conf.TxtPrefix != "" && conf.TxtSuffix != "" {
+		log.Fatal("NewConfig: the TXT prefix and suffix are mutually exclusive, like in external-dns")
+	}
+	if conf.AdminEnabled {
+		host, _, err := net.SplitHostPort(conf.AdminAddress)
+		if err != nil {
+			log.Fatalf("NewConfig: invalid admin address: %s", err)
+		}
+		if conf.AdminToken == "" && !isLoopback(host) {
+			log.Fatal("NewConfig: the admin endpoints can only listen on a non-loopback address if WEBHOOK_HE_ADMIN_TOKEN is set")
+		}
+	}
+	if (conf.ClientCertFile == "") != (conf.ClientKeyFile == "") {
+		log.Fatal("NewConfig: client certificate and key must be supplied together")
+	}
+	if conf.ProxyUrl != "" {
+		proxyUrl, err := url.Parse(conf.ProxyUrl)
+		if err != nil {
+			log.Fatalf("NewConfig: invalid proxy URL: %s", err)
+		}
+		switch proxyUrl.Scheme {
+		case "http", "https", "socks5":
+		default:
+			log.Fatalf("NewConfig: unsupported proxy scheme '%s', must be http, https or socks5", proxyUrl.Scheme)
+		}
+	}
 
 	// regex matches take precedence over plain text matching
 	if conf.RegexDomainFilter != "" {
@@ -58,9 +202,105 @@ func NewConfig() (*Config, *endpoint.DomainFilter, error) {
 	domainFilter := common.CreateDomainFilter(conf.RegexDomainFilter, conf.RegexDomainExclude, conf.DomainFilter, conf.DomainFilterExclude)
 
 	return &Config{
-		Username: conf.Username,
-		Password: conf.Password,
-		Url:      conf.Url,
+		Username:             conf.Username,
+		Password:             conf.Password,
+		TotpSecret:           conf.TotpSecret,
+		Url:                  conf.Url,
+		Transactional:        conf.Transactional,
+		StrictRecords:        conf.StrictRecords,
+		ExcludeReadOnly:      conf.ExcludeReadOnly,
+		AllowZoneDeletion:    conf.AllowZoneDeletion,
+		ZoneConcurrency:      conf.ZoneConcurrency,
+		MaxRequestsPerSecond: conf.MaxRequestsPerSecond,
+		CacheTTL:             conf.CacheTTL,
+		BatchWindow:          conf.BatchWindow,
+		RequestTimeout:       conf.RequestTimeout,
+		OperationTimeout:     conf.OperationTimeout,
+		ConnectTimeout:       conf.ConnectTimeout,
+		ResponseTimeout:      conf.ResponseTimeout,
+		ProxyUrl:             conf.ProxyUrl,
+		CaFile:               conf.CaFile,
+		ClientCertFile:       conf.ClientCertFile,
+		ClientKeyFile:        conf.ClientKeyFile,
+		UserAgent:            conf.UserAgent,
+		ReadinessInterval:    conf.ReadinessInterval,
+		AuditLog:             conf.AuditLog,
+		AuditLogMaxSize:      conf.AuditLogMaxSizeMB * 1024 * 1024,
+		AuditLogMaxFiles:     conf.AuditLogMaxFiles,
+		SnapshotDir:          conf.SnapshotDir,
+		SnapshotMaxPerZone:   conf.SnapshotMaxPerZone,
+		SnapshotMaxAge:       conf.SnapshotMaxAge,
+		BreakerThreshold:     conf.BreakerThreshold,
+		BreakerCooldown:      conf.BreakerCooldown,
+		TxtPrefix:            conf.TxtPrefix,
+		TxtSuffix:            conf.TxtSuffix,
+		AdminEnabled:         conf.AdminEnabled,
+		AdminAddress:         conf.AdminAddress,
+		AdminToken:           conf.AdminToken,
 	}, domainFilter, nil
 
 }
+
+// an empty host means all the interfaces
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// return the settings in a form suitable for display, with the secrets redacted
+func (c *Config) Summary() map[string]string {
+
+	redact := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return "(redacted)"
+	}
+
+	proxyUrl := c.ProxyUrl
+	if parsed, err := url.Parse(c.ProxyUrl); err == nil {
+		// the proxy credentials, if any
+		proxyUrl = parsed.Redacted()
+	}
+
+	return map[string]string{
+		"username":             c.Username,
+		"password":             redact(c.Password),
+		"totpSecret":           redact(c.TotpSecret),
+		"url":                  c.Url,
+		"transactional":        strconv.FormatBool(c.Transactional),
+		"strictRecords":        strconv.FormatBool(c.StrictRecords),
+		"excludeReadOnly":      strconv.FormatBool(c.ExcludeReadOnly),
+		"allowZoneDeletion":    strconv.FormatBool(c.AllowZoneDeletion),
+		"zoneConcurrency":      strconv.Itoa(c.ZoneConcurrency),
+		"maxRequestsPerSecond": strconv.FormatFloat(c.MaxRequestsPerSecond, 'f', -1, 64),
+		"cacheTTL":             c.CacheTTL.String(),
+		"batchWindow":          c.BatchWindow.String(),
+		"requestTimeout":       c.RequestTimeout.String(),
+		"operationTimeout":     c.OperationTimeout.String(),
+		"connectTimeout":       c.ConnectTimeout.String(),
+		"responseTimeout":      c.ResponseTimeout.String(),
+		"readinessInterval":    c.ReadinessInterval.String(),
+		"proxyUrl":             proxyUrl,
+		"caFile":               c.CaFile,
+		"clientCertFile":       c.ClientCertFile,
+		"clientKeyFile":        c.ClientKeyFile,
+		"userAgent":            c.UserAgent,
+		"auditLog":             c.AuditLog,
+		"auditLogMaxSize":      strconv.FormatInt(c.AuditLogMaxSize, 10),
+		"auditLogMaxFiles":     strconv.Itoa(c.AuditLogMaxFiles),
+		"snapshotDir":          c.SnapshotDir,
+		"snapshotMaxPerZone":   strconv.Itoa(c.SnapshotMaxPerZone),
+		"snapshotMaxAge":       c.SnapshotMaxAge.String(),
+		"breakerThreshold":     strconv.Itoa(c.BreakerThreshold),
+		"breakerCooldown":      c.BreakerCooldown.String(),
+		"txtPrefix":            c.TxtPrefix,
+		"txtSuffix":            c.TxtSuffix,
+		"adminEnabled":         strconv.FormatBool(c.AdminEnabled),
+		"adminAddress":         c.AdminAddress,
+		"adminToken":           redact(c.AdminToken),
+	}
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "he_webhook"
+
+// kinds of pages requested to HE, for the page label
+const (
+	PageLogin      = "login"
+	PageTotp       = "totp"
+	PageLogout     = "logout"
+	PageZoneList   = "zone_list"
+	PageZone       = "zone_page"
+	PageCreate     = "create"
+	PageUpdate     = "update"
+	PageDelete     = "delete"
+	PageZoneAdd    = "zone_add"
+	PageZoneDelete = "zone_delete"
+)
+
+var (
+	// requests received by the webhook
+	HttpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests received by the webhook, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	HttpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve the requests received by the webhook.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"route", "method"})
+
+	// requests sent to HE
+	HeRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "he_requests_total",
+		Help:      "Requests sent to HE, by page type and result (HTTP status code, or error).",
+	}, []string{"page", "result"})
+
+	HeRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "he_request_duration_seconds",
+		Help:      "Time taken by the requests sent to HE, by page type.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+	}, []string{"page"})
+
+	LoginFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_failures_total",
+		Help:      "Failed logins to HE.",
+	})
+
+	// rate limiting
+	RateLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_requests_per_second",
+		Help:      "Maximum rate of requests sent to HE, 0 if unlimited.",
+	})
+
+	RateLimitWait = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_wait_seconds_total",
+		Help:      "Time spent waiting for the rate limiter before sending requests to HE.",
+	})
+
+	// circuit breaker
+	CircuitBreakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breaker for requests to HE: 0 closed, 1 half-open, 2 open.",
+	})
+
+	CircuitBreakerRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_rejections_total",
+		Help:      "Requests to HE not sent because the circuit breaker was open.",
+	})
+
+	OperationRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "operation_he_requests",
+		Help:      "Requests sent to HE by the last run of each operation.",
+	}, []string{"operation"})
+
+	// zones and records
+	ZoneRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "zone_records",
+		Help:      "Records in each managed zone, as of the last read (one per target).",
+	}, []string{"zone"})
+
+	ZoneReadSkips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "zone_read_skips_total",
+		Help:      "Times a zone could not be read and was skipped when returning the records.",
+	}, []string{"zone"})
+
+	LastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Time of the last successful run of each operation (GetAllRecords, ApplyChanges).",
+	}, []string{"operation"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HttpRequests,
+		HttpRequestDuration,
+		HeRequests,
+		HeRequestDuration,
+		LoginFailures,
+		RateLimit,
+		RateLimitWait,
+		CircuitBreakerState,
+		CircuitBreakerRejections,
+		OperationRequests,
+		ZoneRecords,
+		ZoneReadSkips,
+		LastSuccess,
+	)
+}
+
+// the handler for /metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,22 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/audit"
+)
+
+var ErrAuditDisabled = errors.New("the audit log is not enabled (WEBHOOK_HE_AUDIT_LOG)")
+
+// return the entries of the audit log matching the filter, oldest first
+func (p *Provider) AuditEntries(filter *audit.Filter) ([]*audit.Entry, error) {
+	if p.config.AuditLog == "" {
+		return nil, fmt.Errorf("AuditEntries: %w", ErrAuditDisabled)
+	}
+	entries, err := audit.Query(p.config.AuditLog, filter)
+	if err != nil {
+		return nil, fmt.Errorf("AuditEntries: %s", err)
+	}
+	return entries, nil
+}
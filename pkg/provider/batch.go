@@ -0,0 +1,280 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// a set of changes waiting to be applied, and where to send its outcome
+type batchRequest struct {
+	changes *plan.Changes
+	// the IDs of the requests the changes come from, for the audit log
+	requestIds []string
+	result     chan error
+}
+
+// changeBatcher collects the changes that arrive within a window of time,
+// starting with the first one, and applies them all together in a single
+// HE session
+type changeBatcher struct {
+	window  time.Duration
+	apply   func(requestIds [][]string, changeSets []*plan.Changes) []error
+	pending []*batchRequest
+	// flushes the pending changes at the end of the window. It's stopped
+	// if they are all withdrawn, and the generation tells a flush started
+	// by a timer that fired anyway from the flush of the current batch
+	timer      *time.Timer
+	generation uint64
+	mutex      sync.Mutex
+	// only one batch is applied at a time
+	applyMutex sync.Mutex
+}
+
+func newChangeBatcher(window time.Duration, apply func([][]string, []*plan.Changes) []error) *changeBatcher {
+	return &changeBatcher{
+		window:  window,
+		apply:   apply,
+		pending: []*batchRequest{},
+	}
+}
+
+// add the changes to the current batch, and wait until it has been applied.
+// If the context is cancelled before the batch is applied, the changes are
+// taken out of it; once the batch is being applied, they can't be stopped
+func (b *changeBatcher) submit(ctx context.Context, changes *plan.Changes) error {
+
+	request := &batchRequest{
+		changes:    changes,
+		requestIds: common.RequestIds(ctx),
+		result:     make(chan error, 1),
+	}
+
+	b.mutex.Lock()
+	b.pending = append(b.pending, request)
+	if len(b.pending) == 1 {
+		b.generation++
+		generation := b.generation
+		b.timer = time.AfterFunc(b.window, func() { b.flush(generation) })
+	}
+	b.mutex.Unlock()
+
+	select {
+	case err := <-request.result:
+		return err
+	case <-ctx.Done():
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, pending := range b.pending {
+		if pending == request {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			// the next request starts a new window
+			if len(b.pending) == 0 {
+				b.timer.Stop()
+				b.timer = nil
+				b.generation++
+			}
+			return fmt.Errorf("ApplyChanges: changes withdrawn from batch: %s", ctx.Err())
+		}
+	}
+	return fmt.Errorf("ApplyChanges: %s (the changes are still being applied)", ctx.Err())
+}
+
+func (b *changeBatcher) flush(generation uint64) {
+
+	b.mutex.Lock()
+	if generation != b.generation {
+		b.mutex.Unlock()
+		return
+	}
+	batch := b.pending
+	b.pending = []*batchRequest{}
+	b.timer = nil
+	b.mutex.Unlock()
+
+	b.applyMutex.Lock()
+	defer b.applyMutex.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	log.Infof("Applying a batch of %d change sets", len(batch))
+	changeSets := []*plan.Changes{}
+	requestIds := [][]string{}
+	for _, request := range batch {
+		changeSets = append(changeSets, request.changes)
+		requestIds = append(requestIds, request.requestIds)
+	}
+	for i, err := range b.apply(requestIds, changeSets) {
+		batch[i].result <- err
+	}
+}
+
+// the single-target records to delete and create in a zone
+type zoneChanges struct {
+	deletions []*endpoint.Endpoint
+	creations []*endpoint.Endpoint
+}
+
+// expand the changes into single-target records, and assign each of them to its zone.
+// We always operate in the most specific zone, eg
+// if we're managing c.d and b.c.d and the operation
+// is about a.b.c.d, we do it in the b.c.d zone
+func splitChanges(changes *plan.Changes, zones map[string]*common.ZoneData) (map[string]*zoneChanges, error) {
+
+	// updates become delete + create
+	toDelete := append(common.ExpandRecords(changes.UpdateOld), common.ExpandRecords(changes.Delete)...)
+	toCreate := append(common.ExpandRecords(changes.UpdateNew), common.ExpandRecords(changes.Create)...)
+
+	log.Debugf("Total records to be deleted: %d (%+v)", len(toDelete), toDelete)
+	log.Debugf("Total records to be created: %d (%+v)", len(toCreate), toCreate)
+
+	split := map[string]*zoneChanges{}
+	zoneFor := func(dnsName string) (*zoneChanges, error) {
+		zone, err := pickZone(dnsName, zones)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Chosen zone %s for %s", zone, dnsName)
+		if _, ok := split[zone]; !ok {
+			split[zone] = &zoneChanges{
+				deletions: []*endpoint.Endpoint{},
+				creations: []*endpoint.Endpoint{},
+			}
+		}
+		return split[zone], nil
+	}
+
+	for _, record := range toDelete {
+		changes, err := zoneFor(record.DNSName)
+		if err != nil {
+			return nil, err
+		}
+		changes.deletions = append(changes.deletions, record)
+	}
+	for _, record := range toCreate {
+		changes, err := zoneFor(record.DNSName)
+		if err != nil {
+			return nil, err
+		}
+		changes.creations = append(changes.creations, record)
+	}
+	return split, nil
+}
+
+// a record to delete or create, its key to find conflicting changes
+// (the zone, name and type: the targets of a name and type are all
+// decided by the same request), and the set of changes it comes from
+type pendingRecord struct {
+	key    string
+	record *endpoint.Endpoint
+	set    int
+}
+
+// mergedChanges combines several sets of changes, in arrival order. When a set
+// touches a name and type that an earlier set also touches, whatever the
+// targets, the operations of the earlier set on that name and type are
+// dropped, so the latest one wins
+type mergedChanges struct {
+	deletions map[string][]*pendingRecord
+	creations map[string][]*pendingRecord
+	// the last set that touched each name and type
+	owners map[string]int
+	// the zones touched by each set
+	zones map[int]map[string]bool
+}
+
+func newMergedChanges() *mergedChanges {
+	return &mergedChanges{
+		deletions: map[string][]*pendingRecord{},
+		creations: map[string][]*pendingRecord{},
+		owners:    map[string]int{},
+		zones:     map[int]map[string]bool{},
+	}
+}
+
+func recordKey(zone string, record *endpoint.Endpoint) string {
+	return fmt.Sprintf("%s/%s/%s", zone, record.DNSName, record.RecordType)
+}
+
+func (m *mergedChanges) add(set int, split map[string]*zoneChanges) {
+
+	m.zones[set] = map[string]bool{}
+	for zone, changes := range split {
+		m.zones[set][zone] = true
+
+		keys := map[string]bool{}
+		for _, record := range append(append([]*endpoint.Endpoint{}, changes.deletions...), changes.creations...) {
+			keys[recordKey(zone, record)] = true
+		}
+		for key := range keys {
+			if owner, ok := m.owners[key]; ok && owner != set {
+				log.Infof("Changes to %s from an earlier request are superseded by a later one", key)
+				m.deletions[zone] = dropRecord(m.deletions[zone], key)
+				m.creations[zone] = dropRecord(m.creations[zone], key)
+			}
+			m.owners[key] = set
+		}
+
+		for _, record := range changes.deletions {
+			m.deletions[zone] = append(m.deletions[zone], &pendingRecord{recordKey(zone, record), record, set})
+		}
+		for _, record := range changes.creations {
+			m.creations[zone] = append(m.creations[zone], &pendingRecord{recordKey(zone, record), record, set})
+		}
+	}
+}
+
+func dropRecord(records []*pendingRecord, key string) []*pendingRecord {
+	kept := []*pendingRecord{}
+	for _, record := range records {
+		if record.key != key {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
+
+// return the records to delete and create in the zone, for all the sets
+func (m *mergedChanges) zoneChanges(zone string) ([]*endpoint.Endpoint, []*endpoint.Endpoint) {
+	return m.setChanges(zone, -1)
+}
+
+// return the records to delete and create in the zone for the given set
+// only, or for all the sets if it's negative
+func (m *mergedChanges) setChanges(zone string, set int) ([]*endpoint.Endpoint, []*endpoint.Endpoint) {
+	deletions := []*endpoint.Endpoint{}
+	for _, pending := range m.deletions[zone] {
+		if set < 0 || pending.set == set {
+			deletions = append(deletions, pending.record)
+		}
+	}
+	creations := []*endpoint.Endpoint{}
+	for _, pending := range m.creations[zone] {
+		if set < 0 || pending.set == set {
+			creations = append(creations, pending.record)
+		}
+	}
+	return deletions, creations
+}
+
+// return the sets of changes that touched the zone, in arrival order
+func (m *mergedChanges) zoneSets(zone string) []int {
+	sets := []int{}
+	for set, zones := range m.zones {
+		if zones[zone] {
+			sets = append(sets, set)
+		}
+	}
+	sort.Ints(sets)
+	return sets
+}
@@ -0,0 +1,138 @@
+package provider
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// a read-through cache of the zone list and of the endpoints of each zone,
+// so that external-dns can poll frequently without every poll turning into
+// a full scrape of HE. A ttl of 0 disables it
+type recordCache struct {
+	ttl time.Duration
+
+	zones       map[string]*common.ZoneData
+	zonesExpiry time.Time
+	endpoints   map[string]*cacheEntry
+
+	mutex sync.Mutex
+	// so tests can move time forward
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	endpoints []*endpoint.Endpoint
+	expiry    time.Time
+}
+
+func newRecordCache(ttl time.Duration) *recordCache {
+	return &recordCache{
+		ttl:       ttl,
+		endpoints: map[string]*cacheEntry{},
+		now:       time.Now,
+	}
+}
+
+func (c *recordCache) enabled() bool {
+	return c.ttl > 0
+}
+
+func (c *recordCache) getZones() (map[string]*common.ZoneData, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.enabled() || c.zones == nil || c.now().After(c.zonesExpiry) {
+		return nil, false
+	}
+
+	zones := map[string]*common.ZoneData{}
+	for zone, zoneData := range c.zones {
+		zones[zone] = zoneData
+	}
+	return zones, true
+}
+
+func (c *recordCache) setZones(zones map[string]*common.ZoneData) {
+	if !c.enabled() {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.zones = map[string]*common.ZoneData{}
+	for zone, zoneData := range zones {
+		c.zones[zone] = zoneData
+	}
+	c.zonesExpiry = c.now().Add(c.ttl)
+}
+
+// return a copy of the cached endpoints of the zone, so callers can modify them
+func (c *recordCache) getEndpoints(zone string) ([]*endpoint.Endpoint, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.endpoints[zone]
+	if !c.enabled() || !ok || c.now().After(entry.expiry) {
+		return nil, false
+	}
+	return copyEndpoints(entry.endpoints), true
+}
+
+func (c *recordCache) setEndpoints(zone string, endpoints []*endpoint.Endpoint) {
+	if !c.enabled() {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.endpoints[zone] = &cacheEntry{
+		endpoints: copyEndpoints(endpoints),
+		expiry:    c.now().Add(c.ttl),
+	}
+}
+
+// forget the endpoints of the given zones
+func (c *recordCache) invalidate(zones ...string) {
+	if !c.enabled() {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, zone := range zones {
+		if _, ok := c.endpoints[zone]; ok {
+			log.Debugf("Cache: invalidating zone %s", zone)
+			delete(c.endpoints, zone)
+		}
+	}
+}
+
+// forget the zone list, eg when zones have been added or deleted
+func (c *recordCache) invalidateZones() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.zones = nil
+}
+
+// forget everything
+func (c *recordCache) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	log.Infof("Cache: flushing all cached zones and records")
+	c.zones = nil
+	c.endpoints = map[string]*cacheEntry{}
+}
+
+func copyEndpoints(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	copied := []*endpoint.Endpoint{}
+	for _, ep := range endpoints {
+		copied = append(copied, ep.DeepCopy())
+	}
+	return copied
+}
@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// return the changes that turn the current records into the desired ones.
+// Records are compared by name, type and target (TTLs are ignored): desired
+// records that don't exist are created, and if prune is set, current records
+// that are not desired are deleted. Records locked by HE are never deleted.
+// ApplyChanges turns a deletion and a creation with the same name and type
+// into an update
+func diffRecords(current []*endpoint.Endpoint, desired []*endpoint.Endpoint, prune bool) *plan.Changes {
+
+	changes := &plan.Changes{
+		Create:    []*endpoint.Endpoint{},
+		UpdateOld: []*endpoint.Endpoint{},
+		UpdateNew: []*endpoint.Endpoint{},
+		Delete:    []*endpoint.Endpoint{},
+	}
+
+	currentRecords := common.ExpandRecords(current)
+	desiredRecords := common.ExpandRecords(desired)
+
+	for _, record := range desiredRecords {
+		if findRecordIndex(currentRecords, record) < 0 {
+			changes.Create = append(changes.Create, endpoint.NewEndpointWithTTL(record.DNSName, record.RecordType, record.RecordTTL, record.Targets[0]))
+		}
+	}
+	if !prune {
+		return changes
+	}
+	for _, record := range currentRecords {
+		if common.IsReadOnly(record) || findRecordIndex(desiredRecords, record) >= 0 {
+			continue
+		}
+		changes.Delete = append(changes.Delete, record)
+	}
+	return changes
+}
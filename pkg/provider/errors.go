@@ -0,0 +1,76 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrZoneDeletionDisabled = errors.New("zone deletion is disabled")
+	ErrInvalidZoneName      = errors.New("invalid zone name")
+	ErrZoneNotFound         = errors.New("zone not found")
+	ErrZoneExists           = errors.New("zone already exists")
+)
+
+// ZoneErrors collects the outcome of ApplyChanges for each zone that
+// had changes, so that failures in some zones can be reported
+// without hiding the zones that were successfully updated
+type ZoneErrors struct {
+	Succeeded []string
+	Failed    []string
+	Errors    map[string]error
+}
+
+func newZoneErrors() *ZoneErrors {
+	return &ZoneErrors{
+		Succeeded: []string{},
+		Failed:    []string{},
+		Errors:    map[string]error{},
+	}
+}
+
+func (e *ZoneErrors) addSuccess(zone string) {
+	e.Succeeded = append(e.Succeeded, zone)
+}
+
+func (e *ZoneErrors) addFailure(zone string, err error) {
+	e.Failed = append(e.Failed, zone)
+	e.Errors[zone] = err
+}
+
+// return the outcome of the given zones only
+func (e *ZoneErrors) only(zones map[string]bool) *ZoneErrors {
+	filtered := newZoneErrors()
+	for _, zone := range e.Succeeded {
+		if zones[zone] {
+			filtered.addSuccess(zone)
+		}
+	}
+	for _, zone := range e.Failed {
+		if zones[zone] {
+			filtered.addFailure(zone, e.Errors[zone])
+		}
+	}
+	return filtered
+}
+
+func (e *ZoneErrors) HasFailures() bool {
+	return len(e.Failed) > 0
+}
+
+func (e *ZoneErrors) Error() string {
+
+	failures := []string{}
+	for _, zone := range e.Failed {
+		failures = append(failures, fmt.Sprintf("%s: %s", zone, e.Errors[zone]))
+	}
+
+	succeeded := "none"
+	if len(e.Succeeded) > 0 {
+		succeeded = strings.Join(e.Succeeded, ", ")
+	}
+
+	return fmt.Sprintf("changes failed for %d of %d zones (%s); succeeded zones: %s",
+		len(e.Failed), len(e.Failed)+len(e.Succeeded), strings.Join(failures, "; "), succeeded)
+}
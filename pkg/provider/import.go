@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// the record types that can be created in HE
+var importableTypes = map[string]bool{
+	"A": true, "AAAA": true, "CNAME": true, "ALIAS": true, "MX": true, "TXT": true, "CAA": true, "AFSDB": true,
+	"HINFO": true, "RP": true, "LOC": true, "NAPTR": true, "PTR": true, "SSHFP": true, "SPF": true, "SRV": true,
+}
+
+// compute the changes that bring the records of the zone in line with the
+// given ones (eg parsed from a zone file): the missing records are created and,
+// if prune is set, those not in records are deleted. SOA and NS records are
+// left alone on both sides, since HE manages them, and records of other zones,
+// wildcards and types HE doesn't support are skipped; the skipped records are
+// returned along with the changes
+func (p *Provider) ImportChanges(ctx context.Context, zone string, records []*endpoint.Endpoint, prune bool) (*plan.Changes, []*endpoint.Endpoint, error) {
+
+	zone, err := normalizeZoneName(zone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ImportChanges: %w", err)
+	}
+
+	desired := []*endpoint.Endpoint{}
+	skipped := []*endpoint.Endpoint{}
+	for _, record := range records {
+		inZone := record.DNSName == zone || strings.HasSuffix(record.DNSName, "."+zone)
+		if !inZone || strings.Contains(record.DNSName, "*") || !importableTypes[record.RecordType] {
+			log.Debugf("ImportChanges: skipping %s", record)
+			skipped = append(skipped, record)
+			continue
+		}
+		desired = append(desired, record)
+	}
+
+	zoneRecords, err := p.ZoneRecords(ctx, zone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ImportChanges: %w", err)
+	}
+	current := []*endpoint.Endpoint{}
+	for _, record := range zoneRecords {
+		if importableTypes[record.RecordType] {
+			current = append(current, record)
+		}
+	}
+
+	return diffRecords(current, desired, prune), skipped, nil
+}
@@ -8,6 +8,6 @@ import (
 
 func NewMockProvider(config *config.Config, domainFilter *endpoint.DomainFilter) *Provider {
 	client := client.NewMockClient(config)
-	provider, _ := NewProvider(client, domainFilter)
+	provider, _ := NewProvider(client, domainFilter, config)
 	return provider
 }
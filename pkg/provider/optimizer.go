@@ -0,0 +1,185 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// an existing record that is overwritten with a new value
+type recordUpdate struct {
+	old *endpoint.Endpoint
+	new *endpoint.Endpoint
+}
+
+// the operations to perform on a zone, after all redundant ones
+// have been removed. All records are single-target, and those
+// to delete and update carry their HE record ID
+type zonePlan struct {
+	deletions []*endpoint.Endpoint
+	updates   []*recordUpdate
+	creations []*endpoint.Endpoint
+	// the zone records before the changes, nil if they were not needed
+	current []*endpoint.Endpoint
+}
+
+func (z *zonePlan) isEmpty() bool {
+	return len(z.deletions) == 0 && len(z.updates) == 0 && len(z.creations) == 0
+}
+
+// return the current zone records, which are needed to plan the changes (and,
+// by the client, to check the IDs of the records to delete), or if the zone
+// must be saved before changing it; nil if there are no changes. The records
+// are read from HE, not from the cache: the zone may have been changed since
+// it was cached, and planning with stale records would drop needed changes
+func (p *Provider) loadZoneRecords(ctx context.Context, zone string, zoneData *common.ZoneData, deletions []*endpoint.Endpoint, creations []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+
+	if p.snapshots == nil && len(creations) == 0 && len(deletions) == 0 {
+		return nil, nil
+	}
+	zoneRecords, err := p.client.GetZoneEndpoints(ctx, zone, zoneData)
+	if err != nil {
+		return nil, fmt.Errorf("loadZoneRecords: %s", err)
+	}
+	if zoneRecords == nil {
+		zoneRecords = []*endpoint.Endpoint{}
+	}
+	return zoneRecords, nil
+}
+
+// return the optimized plan for the zone, given its current records
+// (nil if they were not loaded)
+func planZoneChanges(zone string, zoneRecords []*endpoint.Endpoint, deletions []*endpoint.Endpoint, creations []*endpoint.Endpoint) (*zonePlan, error) {
+
+	var existingRecords []*endpoint.Endpoint
+	if zoneRecords != nil {
+		existingRecords = common.ExpandRecords(zoneRecords)
+	}
+
+	zonePlan := optimizeZonePlan(zone, existingRecords, deletions, creations)
+	zonePlan.current = zoneRecords
+
+	// the changes may not say so, but they could refer to records that HE doesn't let us touch
+	for _, record := range zonePlan.deletions {
+		if common.IsReadOnly(record) {
+			return nil, fmt.Errorf("planZoneChanges: record %s is locked by HE and cannot be deleted", record)
+		}
+	}
+	for _, update := range zonePlan.updates {
+		if common.IsReadOnly(update.old) {
+			return nil, fmt.Errorf("planZoneChanges: record %s is locked by HE and cannot be changed", update.old)
+		}
+	}
+	return zonePlan, nil
+}
+
+// remove no-op and redundant operations from the changes to a zone:
+//   - deletions of records that don't exist in the zone are skipped
+//   - a creation and a deletion of the same existing record cancel out
+//   - creations of records that already exist are skipped
+//   - a deletion and a creation with the same name and type become an update
+//
+// If existingRecords is nil, the zone contents are unknown and only
+// the last step is done. TTLs are not compared: HE records always get
+// the same TTL (see submittedTtl in the client), so a record that only
+// differs in TTL is the same record
+func optimizeZonePlan(zone string, existingRecords []*endpoint.Endpoint, deletions []*endpoint.Endpoint, creations []*endpoint.Endpoint) *zonePlan {
+
+	plan := &zonePlan{
+		deletions: []*endpoint.Endpoint{},
+		updates:   []*recordUpdate{},
+		creations: []*endpoint.Endpoint{},
+	}
+	creations = append([]*endpoint.Endpoint{}, creations...)
+
+	// give every deletion the ID of the record it refers to, skip those that don't exist
+	if existingRecords != nil {
+		resolved := []*endpoint.Endpoint{}
+		for _, record := range deletions {
+			existingRecord := findRecord(existingRecords, record)
+			if existingRecord == nil {
+				log.Infof("Zone %s: skipping deletion of %s, record does not exist", zone, record)
+				continue
+			}
+			recordId, _ := existingRecord.GetProviderSpecificProperty(common.RecordIdTag)
+			record = record.WithProviderSpecific(common.RecordIdTag, recordId)
+			if common.IsReadOnly(existingRecord) {
+				record = record.WithProviderSpecific(common.ReadOnlyTag, "true")
+			}
+			resolved = append(resolved, record)
+		}
+		deletions = resolved
+
+		remaining := []*endpoint.Endpoint{}
+		for _, record := range creations {
+			if i := findRecordIndex(deletions, record); i >= 0 {
+				log.Infof("Zone %s: creation and deletion of %s cancel out, skipping both", zone, record)
+				deletions = append(deletions[:i], deletions[i+1:]...)
+				continue
+			}
+			if findRecord(existingRecords, record) != nil {
+				log.Infof("Zone %s: skipping creation of %s, record already exists", zone, record)
+				continue
+			}
+			remaining = append(remaining, record)
+		}
+		creations = remaining
+	}
+
+	// pair what's left by name and type, in order
+	for _, record := range deletions {
+		recordId, _ := record.GetProviderSpecificProperty(common.RecordIdTag)
+		i := -1
+		if recordId != "" {
+			for j, creation := range creations {
+				if creation.DNSName == record.DNSName && creation.RecordType == record.RecordType {
+					i = j
+					break
+				}
+			}
+		}
+		if i < 0 {
+			plan.deletions = append(plan.deletions, record)
+			continue
+		}
+		update := &recordUpdate{
+			old: record,
+			new: endpoint.NewEndpointWithTTL(creations[i].DNSName, creations[i].RecordType, creations[i].RecordTTL, creations[i].Targets[0]).WithProviderSpecific(common.RecordIdTag, recordId).WithProviderSpecific(common.PreviousTargetTag, record.Targets[0]),
+		}
+		log.Infof("Zone %s: deletion of %s and creation of %s become an update", zone, update.old, update.new)
+		plan.updates = append(plan.updates, update)
+		creations = append(creations[:i], creations[i+1:]...)
+	}
+	plan.creations = creations
+
+	return plan
+}
+
+// look for a single-target record among others with the same name, type and target.
+// If the record has an ID, it's preferred
+func findRecord(records []*endpoint.Endpoint, record *endpoint.Endpoint) *endpoint.Endpoint {
+	if i := findRecordIndex(records, record); i >= 0 {
+		return records[i]
+	}
+	return nil
+}
+
+// the TTL doesn't matter
+func findRecordIndex(records []*endpoint.Endpoint, record *endpoint.Endpoint) int {
+	found := -1
+	recordId, _ := record.GetProviderSpecificProperty(common.RecordIdTag)
+	for i, r := range records {
+		if r.DNSName == record.DNSName && r.RecordType == record.RecordType && r.Targets[0] == record.Targets[0] {
+			if id, _ := r.GetProviderSpecificProperty(common.RecordIdTag); recordId == "" || id == recordId {
+				return i
+			}
+			if found < 0 {
+				found = i
+			}
+		}
+	}
+	return found
+}
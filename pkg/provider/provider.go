@@ -1,73 +1,379 @@
 package provider
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"regexp"
+	"sort"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"github.com/waldner/external-dns-webhook-he/pkg/config"
+	"github.com/waldner/external-dns-webhook-he/pkg/metrics"
+	"github.com/waldner/external-dns-webhook-he/pkg/snapshot"
+	"golang.org/x/sync/singleflight"
 	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/plan"
 )
 
 type Provider struct {
-	client       ClientService
-	domainFilter *endpoint.DomainFilter
+	client          ClientService
+	domainFilter    *endpoint.DomainFilter
+	transactional   bool
+	strictRecords   bool
+	excludeReadOnly bool
+	// whether DeleteZone is allowed at all
+	allowZoneDeletion bool
+	zoneConcurrency   int
+	config            *config.Config
+	cache             *recordCache
+	status            *statusTracker
+	readiness         *readiness
+	// zones are saved here before being changed, nil if disabled
+	snapshots *snapshot.Store
+	// deadline for a whole GetAllRecords or ApplyChanges
+	operationTimeout time.Duration
+	// to coalesce concurrent reads
+	reads singleflight.Group
+	// the context of the read in progress, see joinRead
+	currentRead *sharedRead
+	// to merge changes arriving close together, nil if disabled
+	batcher *changeBatcher
+
+	// number of times each zone had to be skipped by GetAllRecords
+	skippedZoneReads map[string]uint64
+	// number of HE requests sent by the last run of each operation
+	requestCounts map[string]uint64
+	mutex         sync.Mutex
 }
 
 type ClientService interface {
-	DoLogin() error
-	DoLogout() error
-	GetMatchingZones(*endpoint.DomainFilter) (map[string]*common.ZoneData, error)
-	GetZoneEndpoints(zone string, zoneData *common.ZoneData) ([]*endpoint.Endpoint, error)
-	CreateRecords(string, *common.ZoneData, []*endpoint.Endpoint) error
-	DeleteRecords(string, *common.ZoneData, []*endpoint.Endpoint) error
+	RequestCount() uint64
+	RateLimiterState() (float64, float64)
+	CircuitBreakerState() (string, int, time.Time)
+	DoLogin(context.Context) error
+	TryLogin(context.Context) (bool, error)
+	DoLogout(context.Context) error
+	GetMatchingZones(context.Context, *endpoint.DomainFilter) (map[string]*common.ZoneData, error)
+	GetZoneEndpoints(ctx context.Context, zone string, zoneData *common.ZoneData) ([]*endpoint.Endpoint, error)
+	CreateRecords(context.Context, string, *common.ZoneData, []*endpoint.Endpoint) error
+	DeleteRecords(context.Context, string, *common.ZoneData, []*endpoint.Endpoint) error
+	UpdateRecords(context.Context, string, *common.ZoneData, []*endpoint.Endpoint) error
+	AddZone(ctx context.Context, zone string) error
+	DeleteZone(ctx context.Context, zone string, zoneData *common.ZoneData) error
 }
 
 var allEndpoints []*endpoint.Endpoint
 
 // func NewProvider(client *client.HEClient) (*Provider, error) {
-func NewProvider(client ClientService, domainFilter *endpoint.DomainFilter) (*Provider, error) {
-	return &Provider{
-		client,
-		domainFilter,
-	}, nil
+func NewProvider(client ClientService, domainFilter *endpoint.DomainFilter, config *config.Config) (*Provider, error) {
+	provider := &Provider{
+		client:            client,
+		domainFilter:      domainFilter,
+		transactional:     config.Transactional,
+		strictRecords:     config.StrictRecords,
+		excludeReadOnly:   config.ExcludeReadOnly,
+		allowZoneDeletion: config.AllowZoneDeletion,
+		zoneConcurrency:   max(config.ZoneConcurrency, 1),
+		config:            config,
+		cache:             newRecordCache(config.CacheTTL),
+		status:            newStatusTracker(),
+		readiness:         newReadiness(config.ReadinessInterval),
+		operationTimeout:  config.OperationTimeout,
+		skippedZoneReads:  map[string]uint64{},
+		requestCounts:     map[string]uint64{},
+	}
+	snapshots, err := snapshot.NewStore(config.SnapshotDir, config.SnapshotMaxPerZone, config.SnapshotMaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("NewProvider: %s", err)
+	}
+	provider.snapshots = snapshots
+	if config.BatchWindow > 0 {
+		// a batch carries changes from several callers, so it isn't tied to any of them
+		provider.batcher = newChangeBatcher(config.BatchWindow, func(requestIds [][]string, changeSets []*plan.Changes) []error {
+			ctx, cancel := provider.operationContext(context.Background())
+			defer cancel()
+			// the session is shared by all the requests, each set of
+			// changes is tagged with its own ones only
+			for _, setRequestIds := range requestIds {
+				for _, requestId := range setRequestIds {
+					ctx = common.WithRequestId(ctx, requestId)
+				}
+			}
+			return provider.applyChangeSets(ctx, changeSets, requestIds)
+		})
+	}
+	return provider, nil
 }
 
 func (p *Provider) DomainFilter() *endpoint.DomainFilter {
 	return p.domainFilter
 }
 
-func (p *Provider) GetAllRecords() ([]*endpoint.Endpoint, error) {
+// the result of a GetAllRecords, shared by all the callers that asked for it at the same time
+type allRecords struct {
+	endpoints    []*endpoint.Endpoint
+	skippedZones []string
+}
+
+// the context a shared read runs with. It's only cancelled when all
+// the callers waiting for the read have gone away
+type sharedRead struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+func (p *Provider) joinRead() *sharedRead {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.currentRead == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.currentRead = &sharedRead{ctx: ctx, cancel: cancel}
+	}
+	p.currentRead.waiters++
+	return p.currentRead
+}
+
+func (p *Provider) leaveRead(read *sharedRead) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	read.waiters--
+	if read.waiters == 0 {
+		read.cancel()
+		if p.currentRead == read {
+			p.currentRead = nil
+		}
+	}
+}
+
+// the context for a whole operation, with its deadline if there's one
+func (p *Provider) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.operationTimeout > 0 {
+		return context.WithTimeout(ctx, p.operationTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// return all the records in the matching zones, along with the names of the zones
+// that could not be read and were skipped. In strict mode, failing to read
+// any zone makes the whole call fail, as a partial list would make external-dns
+// think that the records in the missing zones must be created again.
+// Concurrent calls are coalesced: only one of them reads from HE, and the others
+// wait for it and get the same result. The read is stopped if all the callers
+// waiting for it are cancelled
+func (p *Provider) GetAllRecords(ctx context.Context) ([]*endpoint.Endpoint, []string, error) {
+
+	read := p.joinRead()
+	defer p.leaveRead(read)
+
+	resultChan := p.reads.DoChan("GetAllRecords", func() (interface{}, error) {
+		ctx, cancel := p.operationContext(read.ctx)
+		defer cancel()
+		start := time.Now()
+		endpoints, skippedZones, err := p.getAllRecords(ctx)
+		p.status.recordOperation("GetAllRecords", start, err)
+		return &allRecords{endpoints, skippedZones}, err
+	})
+
+	var result singleflight.Result
+	select {
+	case result = <-resultChan:
+	case <-ctx.Done():
+		return nil, nil, fmt.Errorf("GetAllRecords: %s", ctx.Err())
+	}
+	if result.Err != nil {
+		return nil, nil, result.Err
+	}
 
-	err := p.client.DoLogin()
+	records := result.Val.(*allRecords)
+	if !result.Shared {
+		return records.endpoints, records.skippedZones, nil
+	}
+	// every caller gets its own copy
+	log.Debugf("GetAllRecords: sharing result with concurrent callers")
+	return copyEndpoints(records.endpoints), append([]string{}, records.skippedZones...), nil
+}
+
+func (p *Provider) getAllRecords(ctx context.Context) ([]*endpoint.Endpoint, []string, error) {
+
+	defer p.countRequests("GetAllRecords", p.client.RequestCount())
+
+	// if everything is cached, we don't even need to log in
+	if endpoints, ok := p.cachedRecords(); ok {
+		log.Infof("GetAllRecords: returning cached records")
+		endpoints = p.visibleRecords(endpoints)
+		allEndpoints = endpoints
+		return endpoints, []string{}, nil
+	}
+
+	err := p.client.DoLogin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("GetAllRecords: %s", err)
+		return nil, nil, fmt.Errorf("GetAllRecords: %s", err)
 	}
 
-	defer p.client.DoLogout()
+	// log out even if we've been cancelled
+	defer p.client.DoLogout(context.WithoutCancel(ctx))
 
-	zones, err := p.client.GetMatchingZones(p.domainFilter)
+	zones, err := p.client.GetMatchingZones(ctx, p.domainFilter)
 	if err != nil {
-		return nil, fmt.Errorf("GetAllRecords: %s", err)
+		return nil, nil, fmt.Errorf("GetAllRecords: %s", err)
 	}
+	p.cache.setZones(zones)
 
 	log.Debugf("Matching zones according to domain filter: %v", zones)
 
-	allEndpoints = []*endpoint.Endpoint{}
+	sorted := sortedZones(zones)
+	results := p.readZones(ctx, sorted, zones)
 
-	for zone, zoneData := range zones {
-		endpoints, err := p.client.GetZoneEndpoints(zone, zoneData)
-		if err != nil {
-			log.Errorf("GetAllRecords: error getting zone records for '%s': %s", zone, err)
+	// the failures are about us, not about the zones
+	if err := ctx.Err(); err != nil {
+		return nil, nil, fmt.Errorf("GetAllRecords: %s", err)
+	}
+
+	endpoints := []*endpoint.Endpoint{}
+	skippedZones := []string{}
+	zoneRecords := map[string]int{}
+
+	// results are in the same order as the sorted zones, whatever
+	// the order in which the zone pages were actually loaded
+	for i, zone := range sorted {
+		if results[i].err != nil {
+			if p.strictRecords {
+				return nil, nil, fmt.Errorf("GetAllRecords: error getting zone records for '%s' (strict mode): %s", zone, results[i].err)
+			}
+			log.Errorf("GetAllRecords: error getting zone records for '%s': %s", zone, results[i].err)
 			log.Warnf("Skipping zone '%s'", zone)
+			skippedZones = append(skippedZones, zone)
+			p.countSkippedZone(zone)
 			continue
 		}
-		allEndpoints = append(allEndpoints, endpoints...)
+		endpoints = append(endpoints, results[i].endpoints...)
+		zoneRecords[zone] = len(common.ExpandRecords(results[i].endpoints))
+	}
+
+	// zones that are no longer there (or have been skipped) disappear from the metrics
+	metrics.ZoneRecords.Reset()
+	for zone, count := range zoneRecords {
+		metrics.ZoneRecords.WithLabelValues(zone).Set(float64(count))
 	}
+	p.status.setZoneRecords(zoneRecords, skippedZones)
+	metrics.LastSuccess.WithLabelValues("GetAllRecords").SetToCurrentTime()
+
+	endpoints = p.visibleRecords(endpoints)
+	allEndpoints = endpoints
+	return endpoints, skippedZones, nil
+
+}
 
-	return allEndpoints, nil
+// leave out the read-only records, if so configured
+func (p *Provider) visibleRecords(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	if !p.excludeReadOnly {
+		return endpoints
+	}
+	visible := []*endpoint.Endpoint{}
+	for _, ep := range endpoints {
+		if common.IsReadOnly(ep) {
+			log.Debugf("Leaving out read-only record %s", ep)
+			continue
+		}
+		visible = append(visible, ep)
+	}
+	return visible
+}
 
+type zoneResult struct {
+	endpoints []*endpoint.Endpoint
+	err       error
+}
+
+// return all the records from the cache, if the zone list and all the zones are there
+func (p *Provider) cachedRecords() ([]*endpoint.Endpoint, bool) {
+
+	zones, ok := p.cache.getZones()
+	if !ok {
+		return nil, false
+	}
+
+	endpoints := []*endpoint.Endpoint{}
+	for _, zone := range sortedZones(zones) {
+		zoneEndpoints, ok := p.cache.getEndpoints(zone)
+		if !ok {
+			return nil, false
+		}
+		endpoints = append(endpoints, zoneEndpoints...)
+	}
+	return endpoints, true
+}
+
+// return the endpoints of the zone from the cache, or from HE if not cached
+func (p *Provider) getZoneEndpoints(ctx context.Context, zone string, zoneData *common.ZoneData) ([]*endpoint.Endpoint, error) {
+
+	if endpoints, ok := p.cache.getEndpoints(zone); ok {
+		log.Debugf("Zone %s: using cached records", zone)
+		return endpoints, nil
+	}
+
+	endpoints, err := p.client.GetZoneEndpoints(ctx, zone, zoneData)
+	if err != nil {
+		return nil, err
+	}
+	p.cache.setEndpoints(zone, endpoints)
+	return endpoints, nil
+}
+
+// empty the record cache, so the next read goes to HE
+func (p *Provider) FlushCache() {
+	p.cache.flush()
+}
+
+// load the given zones, using up to zoneConcurrency workers. Every
+// request still goes through the client's rate limiter
+func (p *Provider) readZones(ctx context.Context, names []string, zones map[string]*common.ZoneData) []*zoneResult {
+
+	results := make([]*zoneResult, len(names))
+
+	semaphore := make(chan struct{}, p.zoneConcurrency)
+	var wg sync.WaitGroup
+
+	for i, zone := range names {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, zone string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			endpoints, err := p.getZoneEndpoints(ctx, zone, zones[zone])
+			results[i] = &zoneResult{endpoints, err}
+		}(i, zone)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (p *Provider) countSkippedZone(zone string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.skippedZoneReads[zone]++
+	metrics.ZoneReadSkips.WithLabelValues(zone).Inc()
+}
+
+// return how many times each zone has been skipped by GetAllRecords
+// because it could not be read
+func (p *Provider) SkippedZoneReads() map[string]uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	skipped := map[string]uint64{}
+	for zone, count := range p.skippedZoneReads {
+		skipped[zone] = count
+	}
+	return skipped
 }
 
 // here is where we add provider-specific properties to the desired endpoints,
@@ -77,24 +383,61 @@ func (p *Provider) AdjustEndpoints(desiredEndpoints []*endpoint.Endpoint) ([]*en
 
 	adjustedEndpoints := []*endpoint.Endpoint{}
 
-	for _, endpoint := range common.ExpandRecords(desiredEndpoints) {
+	// like the ones we return in GetAllRecords, desired endpoints must
+	// have all the targets for a name and type together
+	for _, ep := range common.AggregateRecords(desiredEndpoints) {
 		// look for endpoint in allEndpoints
-		log.Debugf("Adjustendpoints: looking for endpoint %s in allEndpoints", endpoint)
-		for _, existingEndpoint := range allEndpoints {
-			if existingEndpoint.DNSName == endpoint.DNSName && existingEndpoint.RecordType == endpoint.RecordType && existingEndpoint.Targets[0] == endpoint.Targets[0] {
-				// copy provider-specific stuff
-				endpoint.ProviderSpecific = existingEndpoint.ProviderSpecific
-				break
+		log.Debugf("Adjustendpoints: looking for endpoint %s in allEndpoints", ep)
+
+		var existingEndpoint *endpoint.Endpoint
+		for _, e := range allEndpoints {
+			if e.DNSName == ep.DNSName && e.RecordType == ep.RecordType {
+				existingEndpoint = e
+				if e.Targets.Same(ep.Targets) {
+					break
+				}
 			}
+		}
 
+		if existingEndpoint != nil {
+			if existingEndpoint.Targets.Same(ep.Targets) {
+				// copy provider-specific stuff, and use the same target order
+				// so that the record IDs still match their targets
+				ep.Targets = append(endpoint.Targets{}, existingEndpoint.Targets...)
+				ep.ProviderSpecific = existingEndpoint.ProviderSpecific
+			} else {
+				// only keep the IDs of the targets that already exist
+				common.SetRecordIds(ep, existingRecordIds(ep, existingEndpoint))
+			}
 		}
-		adjustedEndpoints = append(adjustedEndpoints, endpoint)
+		adjustedEndpoints = append(adjustedEndpoints, ep)
 	}
 
 	return adjustedEndpoints, nil
 }
 
-func (p *Provider) ApplyChanges(changes *plan.Changes) error {
+// return the record IDs that the targets of ep have in existingEndpoint
+func existingRecordIds(ep *endpoint.Endpoint, existingEndpoint *endpoint.Endpoint) []string {
+	recordIds := []string{}
+	existingRecords := common.ExpandRecords([]*endpoint.Endpoint{existingEndpoint})
+	for _, target := range ep.Targets {
+		recordId := ""
+		for _, existingRecord := range existingRecords {
+			if existingRecord.Targets[0] == target {
+				recordId, _ = existingRecord.GetProviderSpecificProperty(common.RecordIdTag)
+				break
+			}
+		}
+		recordIds = append(recordIds, recordId)
+	}
+	return recordIds
+}
+
+// apply the changes, zone by zone. With a batching window, the changes are
+// merged with those of other calls arriving in the same window, and the
+// returned error only concerns the zones touched by these changes.
+// If the context is cancelled, no further record operations are sent
+func (p *Provider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
 
 	log.Debugf("Changes requested (before expansion): create: %d, updateOld: %d, updateNew: %d, delete: %d", len(changes.Create), len(changes.UpdateOld), len(changes.UpdateNew), len(changes.Delete))
 
@@ -103,84 +446,312 @@ func (p *Provider) ApplyChanges(changes *plan.Changes) error {
 		return nil
 	}
 
+	if p.batcher != nil {
+		return p.batcher.submit(ctx, changes)
+	}
+
+	ctx, cancel := p.operationContext(ctx)
+	defer cancel()
+	return p.applyChangeSets(ctx, []*plan.Changes{changes}, nil)[0]
+}
+
+// apply several sets of changes in a single HE session, and return
+// the outcome of each of them. requestIds has the IDs of the requests
+// each set comes from, for the audit log; if nil, those in ctx are used
+// for all the sets
+func (p *Provider) applyChangeSets(ctx context.Context, changeSets []*plan.Changes, requestIds [][]string) []error {
+
+	results := make([]error, len(changeSets))
+
+	// all the record operations done here are part of this batch
+	batchId := common.NewBatchId()
+	ctx = common.WithBatchId(ctx, batchId)
+	log.Infof("ApplyChanges: applying batch %s", batchId)
+
+	defer func(start time.Time) {
+		p.status.recordOperation("ApplyChanges", start, errors.Join(results...))
+	}(time.Now())
+	failAll := func(err error) []error {
+		for i := range results {
+			results[i] = fmt.Errorf("ApplyChanges: %s", err)
+		}
+		return results
+	}
+
 	// updates become delete + create
 	// we should also group changes by zone, so
 	// all changes related to a zone are applied together later
 
-	err := p.client.DoLogin()
+	defer p.countRequests("ApplyChanges", p.client.RequestCount())
+
+	err := p.client.DoLogin(ctx)
 	if err != nil {
-		return fmt.Errorf("ApplyChanges: %s", err)
+		return failAll(err)
 	}
 
-	defer p.client.DoLogout()
-
-	// group requested changes into creations and deletions
-	toDelete := append(common.ExpandRecords(changes.UpdateOld), common.ExpandRecords(changes.Delete)...)
-	toCreate := append(common.ExpandRecords(changes.UpdateNew), common.ExpandRecords(changes.Create)...)
-
-	log.Debugf("Total records to be deleted: %d (%+v)", len(toDelete), toDelete)
-	log.Debugf("Total records to be created: %d (%+v)", len(toCreate), toCreate)
+	// log out even if we've been cancelled
+	defer p.client.DoLogout(context.WithoutCancel(ctx))
 
 	// get all the zones we're handling
-	zones, err := p.client.GetMatchingZones(p.domainFilter)
+	zones, err := p.client.GetMatchingZones(ctx, p.domainFilter)
 	if err != nil {
-		return fmt.Errorf("ApplyChanges: %s", err)
+		return failAll(err)
 	}
 	log.Debugf("Matching zones: %s", zones)
 
-	// now assign operations to each zone
-	zoneDeletions := map[string]([]*endpoint.Endpoint){}
-	zoneCreations := map[string]([]*endpoint.Endpoint){}
+	// determine which zone to use for each change, and merge them
+	merged := newMergedChanges()
+	for i, changes := range changeSets {
+		if err := checkReadOnly(changes); err != nil {
+			results[i] = fmt.Errorf("ApplyChanges: %s", err)
+			continue
+		}
+		zoneChanges, err := splitChanges(changes, zones)
+		if err != nil {
+			results[i] = fmt.Errorf("ApplyChanges: %s", err)
+			continue
+		}
+		merged.add(i, zoneChanges)
+	}
 
-	// init all zones with no operation
-	for zone := range zones {
-		zoneDeletions[zone] = []*endpoint.Endpoint{}
-		zoneCreations[zone] = []*endpoint.Endpoint{}
+	// each zone is handled independently, so a failure in one of them
+	// doesn't prevent the changes to the others from being applied.
+	// Within a zone, the changes of each set are planned and applied on
+	// their own, so that a failure (or a rollback) only affects the set
+	// it belongs to, and each set gets only the outcome of its own changes
+	setErrors := make([]*ZoneErrors, len(changeSets))
+	for i := range setErrors {
+		setErrors[i] = newZoneErrors()
+	}
+	failed := false
+	for _, zone := range sortedZones(zones) {
+		sets := merged.zoneSets(zone)
+		if len(sets) == 0 {
+			continue
+		}
+		failZone := func(err error) {
+			log.Errorf("ApplyChanges: zone %s: %s", zone, err)
+			for _, set := range sets {
+				setErrors[set].addFailure(zone, err)
+			}
+			failed = true
+		}
+
+		zoneDeletions, zoneCreations := merged.zoneChanges(zone)
+		if len(zoneDeletions) == 0 && len(zoneCreations) == 0 {
+			log.Infof("Zone %s: all the changes have been superseded", zone)
+			for _, set := range sets {
+				setErrors[set].addSuccess(zone)
+			}
+			continue
+		}
+
+		// if we've been cancelled, don't even start with the remaining zones
+		if err := ctx.Err(); err != nil {
+			failZone(fmt.Errorf("not applied: %s", err))
+			continue
+		}
+
+		// whatever happens, the cached records for this zone can't be trusted anymore
+		defer p.cache.invalidate(zone)
+
+		// the zone is loaded (and saved) only once for all the sets
+		zoneRecords, err := p.loadZoneRecords(ctx, zone, zones[zone], zoneDeletions, zoneCreations)
+		if err != nil {
+			failZone(err)
+			continue
+		}
+		saved := false
+
+		for _, set := range sets {
+			deletions, creations := merged.setChanges(zone, set)
+			setCtx := ctx
+			if requestIds != nil {
+				setCtx = common.WithRequestIds(ctx, requestIds[set])
+			}
+
+			zonePlan, err := planZoneChanges(zone, zoneRecords, deletions, creations)
+			if err == nil && !saved && !zonePlan.isEmpty() {
+				err = p.saveSnapshot(ctx, zone, zonePlan)
+				saved = err == nil
+			}
+			if err == nil {
+				if err = ctx.Err(); err != nil {
+					err = fmt.Errorf("not applied: %s", err)
+				}
+			}
+			if err == nil {
+				if p.transactional {
+					err = p.applyZoneChangesTransactional(setCtx, zone, zones[zone], zonePlan)
+				} else {
+					err = p.applyZoneChanges(setCtx, zone, zones[zone], zonePlan)
+				}
+			}
+
+			if err != nil {
+				log.Errorf("ApplyChanges: zone %s: %s", zone, err)
+				setErrors[set].addFailure(zone, err)
+				failed = true
+				continue
+			}
+			setErrors[set].addSuccess(zone)
+		}
 	}
 
-	// determine which zone to use.
-	// We always operate in the most specific zone, eg
-	// if we're managing c.d and b.c.d and the operation
-	// is about a.b.c.d, we do it in the b.c.d zone
+	if !failed {
+		metrics.LastSuccess.WithLabelValues("ApplyChanges").SetToCurrentTime()
+	}
+
+	for i := range changeSets {
+		if results[i] == nil && setErrors[i].HasFailures() {
+			results[i] = fmt.Errorf("ApplyChanges: %w", setErrors[i])
+		}
+	}
+	return results
+}
+
+func (p *Provider) applyZoneChanges(ctx context.Context, zone string, zoneData *common.ZoneData, zonePlan *zonePlan) error {
 
-	for _, endpoint := range toDelete {
-		zone, err := pickZone(endpoint.DNSName, zones)
+	if zonePlan.isEmpty() {
+		log.Infof("Zone %s: nothing left to do", zone)
+		return nil
+	}
+
+	// do deletions first
+	if len(zonePlan.deletions) > 0 {
+		log.Infof("Zone %s: %d deletions", zone, len(zonePlan.deletions))
+		err := p.client.DeleteRecords(ctx, zone, zoneData, zonePlan.deletions)
 		if err != nil {
-			return fmt.Errorf("ApplyChanges: %s", err)
+			return fmt.Errorf("applyZoneChanges: %s", err)
 		}
-		log.Debugf("Chosen zone %s for deletion of %s/%s", zone, endpoint.DNSName, endpoint.RecordType)
-		zoneDeletions[zone] = append(zoneDeletions[zone], endpoint)
 	}
-	for _, endpoint := range toCreate {
-		zone, err := pickZone(endpoint.DNSName, zones)
+	if len(zonePlan.updates) > 0 {
+		log.Infof("Zone %s: %d updates", zone, len(zonePlan.updates))
+		records := []*endpoint.Endpoint{}
+		for _, update := range zonePlan.updates {
+			records = append(records, update.new)
+		}
+		err := p.client.UpdateRecords(ctx, zone, zoneData, records)
 		if err != nil {
-			return fmt.Errorf("ApplyChanges: %s", err)
+			return fmt.Errorf("applyZoneChanges: %s", err)
+		}
+	}
+	if len(zonePlan.creations) > 0 {
+		log.Infof("Zone %s: %d creations", zone, len(zonePlan.creations))
+		err := p.client.CreateRecords(ctx, zone, zoneData, zonePlan.creations)
+		if err != nil {
+			return fmt.Errorf("applyZoneChanges: %s", err)
+		}
+	}
+	return nil
+}
+
+// same as applyZoneChanges, but operations are sent one record at a time,
+// and if one fails, those already done in the zone are rolled back
+func (p *Provider) applyZoneChangesTransactional(ctx context.Context, zone string, zoneData *common.ZoneData, zonePlan *zonePlan) error {
+
+	tx := newTransaction(p.client)
+
+	err := p.applyZoneOperations(ctx, tx, zone, zoneData, zonePlan)
+	if err != nil {
+		// the rollback must happen even if we've been cancelled
+		if rbErr := tx.rollback(context.WithoutCancel(ctx)); rbErr != nil {
+			return fmt.Errorf("applyZoneChangesTransactional: %s; %s", err, rbErr)
+		}
+		return fmt.Errorf("applyZoneChangesTransactional: %s; all %d completed operations were rolled back", err, len(tx.done))
+	}
+	return nil
+}
+
+// send operations one record at a time, adding every successful
+// one to the transaction
+func (p *Provider) applyZoneOperations(ctx context.Context, tx *transaction, zone string, zoneData *common.ZoneData, zonePlan *zonePlan) error {
+
+	if zonePlan.isEmpty() {
+		log.Infof("Zone %s: nothing left to do", zone)
+		return nil
+	}
+
+	if len(zonePlan.deletions) > 0 {
+		log.Infof("Zone %s: %d deletions", zone, len(zonePlan.deletions))
+		for _, record := range zonePlan.deletions {
+			err := p.client.DeleteRecords(ctx, zone, zoneData, []*endpoint.Endpoint{record})
+			if err != nil {
+				return fmt.Errorf("applyZoneOperations: %s", err)
+			}
+			tx.add(opDelete, zone, zoneData, record, nil)
 		}
-		log.Debugf("Chosen zone %s for creation of %s/%s", zone, endpoint.DNSName, endpoint.RecordType)
-		zoneCreations[zone] = append(zoneCreations[zone], endpoint)
 	}
 
-	for zone, zoneData := range zones {
-		// do deletions first
-		if len(zoneDeletions[zone]) > 0 {
-			log.Infof("Zone %s: %d deletions", zone, len(zoneDeletions[zone]))
-			err = p.client.DeleteRecords(zone, zoneData, zoneDeletions[zone])
+	if len(zonePlan.updates) > 0 {
+		log.Infof("Zone %s: %d updates", zone, len(zonePlan.updates))
+		for _, update := range zonePlan.updates {
+			err := p.client.UpdateRecords(ctx, zone, zoneData, []*endpoint.Endpoint{update.new})
 			if err != nil {
-				return fmt.Errorf("ApplyChanges: %s", err)
+				return fmt.Errorf("applyZoneOperations: %s", err)
 			}
+			tx.add(opUpdate, zone, zoneData, update.new, update.old)
 		}
-		if len(zoneCreations[zone]) > 0 {
-			log.Infof("Zone %s: %d creations", zone, len(zoneCreations[zone]))
-			err = p.client.CreateRecords(zone, zoneData, zoneCreations[zone])
+	}
+
+	if len(zonePlan.creations) > 0 {
+		log.Infof("Zone %s: %d creations", zone, len(zonePlan.creations))
+		for _, record := range zonePlan.creations {
+			err := p.client.CreateRecords(ctx, zone, zoneData, []*endpoint.Endpoint{record})
 			if err != nil {
-				return fmt.Errorf("ApplyChanges: %s", err)
+				return fmt.Errorf("applyZoneOperations: %s", err)
 			}
+			tx.add(opCreate, zone, zoneData, record, nil)
 		}
+	}
+
+	return nil
+}
+
+func (p *Provider) countRequests(operation string, start uint64) {
+	count := p.client.RequestCount() - start
+	log.Infof("%s: sent %d requests to HE", operation, count)
 
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.requestCounts[operation] = count
+	metrics.OperationRequests.WithLabelValues(operation).Set(float64(count))
+}
+
+// return the number of requests sent to HE by the last run of each
+// operation (GetAllRecords, ApplyChanges). If operations overlap, the
+// counts include each other's requests
+func (p *Provider) RequestCounts() map[string]uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	counts := map[string]uint64{}
+	for operation, count := range p.requestCounts {
+		counts[operation] = count
+	}
+	return counts
+}
+
+// refuse changes that would delete or modify records marked as read-only
+func checkReadOnly(changes *plan.Changes) error {
+	for _, ep := range append(append([]*endpoint.Endpoint{}, changes.Delete...), changes.UpdateOld...) {
+		if common.IsReadOnly(ep) {
+			return fmt.Errorf("checkReadOnly: record %s is locked by HE and cannot be changed or deleted", ep)
+		}
 	}
 	return nil
 }
 
+// return the zone names in a stable order
+func sortedZones(zones map[string]*common.ZoneData) []string {
+	names := []string{}
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // remove each part of the label starting from the left
 // until we find a zone that we manage
 func pickZone(dnsName string, zones map[string]*common.ZoneData) (string, error) {
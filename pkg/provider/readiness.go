@@ -0,0 +1,110 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the outcome of the last readiness check, reused for a while so that
+// frequent probes don't cause a login to HE each time
+type readiness struct {
+	interval  time.Duration
+	checkedAt time.Time
+	err       error
+	mutex     sync.Mutex
+}
+
+func newReadiness(interval time.Duration) *readiness {
+	return &readiness{interval: interval}
+}
+
+// return the last result, if it's recent enough
+func (r *readiness) get() (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.checkedAt.IsZero() || time.Since(r.checkedAt) >= r.interval {
+		return false, nil
+	}
+	return true, r.err
+}
+
+// return the last result, however old (nil if there's none yet)
+func (r *readiness) last() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *readiness) set(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.checkedAt = time.Now()
+	r.err = err
+}
+
+var errSessionBusy = errors.New("another operation is using the HE session")
+
+// check that we can work with HE: the login succeeds, the zone list page
+// can be parsed, and the domain filter matches at least one zone. The result
+// is reused for the configured interval, and concurrent callers share the
+// same check. A check that has started goes on even if the caller goes away,
+// so that a slow HE doesn't cause a new login at every probe. If another
+// operation is using the HE session, which may take much longer than a probe
+// can wait, the last result is returned (or success, if there's none yet)
+func (p *Provider) CheckReadiness(ctx context.Context) error {
+
+	if ok, err := p.readiness.get(); ok {
+		return err
+	}
+
+	resultChan := p.reads.DoChan("CheckReadiness", func() (interface{}, error) {
+		ctx, cancel := p.operationContext(context.WithoutCancel(ctx))
+		defer cancel()
+		start := time.Now()
+		err := p.checkReadiness(ctx)
+		if errors.Is(err, errSessionBusy) {
+			log.Debugf("CheckReadiness: %s, keeping the last result", err)
+			return nil, p.readiness.last()
+		}
+		p.status.recordOperation("CheckReadiness", start, err)
+		if err != nil {
+			log.Warnf("CheckReadiness: not ready: %s", err)
+		}
+		p.readiness.set(err)
+		return nil, err
+	})
+
+	select {
+	case result := <-resultChan:
+		return result.Err
+	case <-ctx.Done():
+		return fmt.Errorf("CheckReadiness: %s", ctx.Err())
+	}
+}
+
+func (p *Provider) checkReadiness(ctx context.Context) error {
+
+	started, err := p.client.TryLogin(ctx)
+	if err != nil {
+		return fmt.Errorf("CheckReadiness: %s", err)
+	}
+	if !started {
+		return fmt.Errorf("CheckReadiness: %w", errSessionBusy)
+	}
+
+	defer p.client.DoLogout(context.WithoutCancel(ctx))
+
+	zones, err := p.client.GetMatchingZones(ctx, p.domainFilter)
+	if err != nil {
+		return fmt.Errorf("CheckReadiness: %s", err)
+	}
+	if len(zones) == 0 {
+		return fmt.Errorf("CheckReadiness: no zone in the HE account matches the domain filter")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"github.com/waldner/external-dns-webhook-he/pkg/snapshot"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+var ErrSnapshotsDisabled = errors.New("snapshots are not enabled (WEBHOOK_HE_SNAPSHOT_DIR)")
+
+// save the zone as it is before applying the plan, if snapshots are enabled.
+// If it can't be saved, the zone is not changed
+func (p *Provider) saveSnapshot(ctx context.Context, zone string, zonePlan *zonePlan) error {
+
+	if p.snapshots == nil || zonePlan.isEmpty() {
+		return nil
+	}
+
+	name, err := p.snapshots.Save(zone, common.BatchId(ctx), zonePlan.current)
+	if err != nil {
+		return fmt.Errorf("saveSnapshot: cannot save zone %s, not changing it: %s", zone, err)
+	}
+	log.Infof("Zone %s: saved snapshot %s", zone, name)
+	return nil
+}
+
+// return the names of the snapshots of the zone, oldest first
+func (p *Provider) Snapshots(zone string) ([]string, error) {
+
+	if p.snapshots == nil {
+		return nil, fmt.Errorf("Snapshots: %w", ErrSnapshotsDisabled)
+	}
+	zone, err := normalizeZoneName(zone)
+	if err != nil {
+		return nil, fmt.Errorf("Snapshots: %w", err)
+	}
+	names, err := p.snapshots.List(zone)
+	if err != nil {
+		return nil, fmt.Errorf("Snapshots: %s", err)
+	}
+	return names, nil
+}
+
+// compute the changes that bring the zone back to the snapshot (the most
+// recent one if name is empty): the records added since are deleted, and
+// those deleted or changed since are created again
+func (p *Provider) RestoreChanges(ctx context.Context, zone string, name string) (*snapshot.Snapshot, *plan.Changes, error) {
+
+	if p.snapshots == nil {
+		return nil, nil, fmt.Errorf("RestoreChanges: %w", ErrSnapshotsDisabled)
+	}
+	zone, err := normalizeZoneName(zone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("RestoreChanges: %w", err)
+	}
+
+	saved, err := p.snapshots.Load(zone, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("RestoreChanges: %w", err)
+	}
+	current, err := p.ZoneRecords(ctx, zone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("RestoreChanges: %w", err)
+	}
+	return saved, diffRecords(current, saved.Endpoints, true), nil
+}
@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"sync"
+	"time"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// how many errors are kept for the status
+const maxRecentErrors = 20
+
+type OperationStatus struct {
+	LastRun     time.Time  `json:"lastRun"`
+	Duration    string     `json:"duration"`
+	Success     bool       `json:"success"`
+	Error       string     `json:"error,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	// requests sent to HE by the last run
+	Requests uint64 `json:"requests"`
+}
+
+type ZoneStatus struct {
+	// as of the last successful read, one per target
+	Records      int    `json:"records"`
+	SkippedReads uint64 `json:"skippedReads"`
+}
+
+type ErrorStatus struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Error     string    `json:"error"`
+}
+
+type RateLimiterStatus struct {
+	// 0 means unlimited
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// requests that can be sent right now without waiting
+	Available     float64 `json:"available"`
+	TotalRequests uint64  `json:"totalRequests"`
+}
+
+type CircuitBreakerStatus struct {
+	// closed, open, half-open (one request is let through to see if HE
+	// works again) or disabled
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastOpened          *time.Time `json:"lastOpened,omitempty"`
+}
+
+type Status struct {
+	Config         map[string]string           `json:"config"`
+	DomainFilter   *endpoint.DomainFilter      `json:"domainFilter"`
+	Zones          map[string]*ZoneStatus      `json:"zones"`
+	Operations     map[string]*OperationStatus `json:"operations"`
+	RecentErrors   []*ErrorStatus              `json:"recentErrors"`
+	RateLimiter    *RateLimiterStatus          `json:"rateLimiter"`
+	CircuitBreaker *CircuitBreakerStatus       `json:"circuitBreaker"`
+}
+
+// keeps the outcome of the last operations, for the status
+type statusTracker struct {
+	operations map[string]*OperationStatus
+	// zone -> records, from the last read of all records
+	zoneRecords map[string]int
+	// the most recent last
+	errors []*ErrorStatus
+	mutex  sync.Mutex
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{
+		operations:  map[string]*OperationStatus{},
+		zoneRecords: map[string]int{},
+		errors:      []*ErrorStatus{},
+	}
+}
+
+func (s *statusTracker) recordOperation(operation string, start time.Time, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status, ok := s.operations[operation]
+	if !ok {
+		status = &OperationStatus{}
+		s.operations[operation] = status
+	}
+	status.LastRun = start
+	status.Duration = time.Since(start).Round(time.Millisecond).String()
+	status.Success = err == nil
+	status.Error = ""
+	if err != nil {
+		status.Error = err.Error()
+		s.addError(operation, err)
+		return
+	}
+	status.LastSuccess = &start
+}
+
+// must be called with the mutex held
+func (s *statusTracker) addError(operation string, err error) {
+	s.errors = append(s.errors, &ErrorStatus{Time: time.Now(), Operation: operation, Error: err.Error()})
+	if len(s.errors) > maxRecentErrors {
+		s.errors = s.errors[len(s.errors)-maxRecentErrors:]
+	}
+}
+
+// the zones that could not be read keep the count of their last successful read
+func (s *statusTracker) setZoneRecords(zoneRecords map[string]int, skippedZones []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, zone := range skippedZones {
+		if count, ok := s.zoneRecords[zone]; ok {
+			zoneRecords[zone] = count
+		}
+	}
+	s.zoneRecords = zoneRecords
+}
+
+// return the current state of the provider: configuration, managed zones,
+// outcome of the last operations, recent errors, and the state of the
+// rate limiter and of the circuit breaker
+func (p *Provider) Status() *Status {
+
+	status := &Status{
+		Config:       p.config.Summary(),
+		DomainFilter: p.domainFilter,
+		Zones:        map[string]*ZoneStatus{},
+		Operations:   map[string]*OperationStatus{},
+		RecentErrors: []*ErrorStatus{},
+	}
+
+	requestCounts := p.RequestCounts()
+	skippedZoneReads := p.SkippedZoneReads()
+
+	p.status.mutex.Lock()
+	for zone, records := range p.status.zoneRecords {
+		status.Zones[zone] = &ZoneStatus{Records: records}
+	}
+	for operation, operationStatus := range p.status.operations {
+		copied := *operationStatus
+		copied.Requests = requestCounts[operation]
+		status.Operations[operation] = &copied
+	}
+	// the most recent first
+	for i := len(p.status.errors) - 1; i >= 0; i-- {
+		status.RecentErrors = append(status.RecentErrors, p.status.errors[i])
+	}
+	p.status.mutex.Unlock()
+
+	for zone, count := range skippedZoneReads {
+		if zoneStatus, ok := status.Zones[zone]; ok {
+			zoneStatus.SkippedReads = count
+		}
+	}
+
+	limit, available := p.client.RateLimiterState()
+	status.RateLimiter = &RateLimiterStatus{
+		RequestsPerSecond: limit,
+		Available:         available,
+		TotalRequests:     p.client.RequestCount(),
+	}
+
+	state, failures, openedAt := p.client.CircuitBreakerState()
+	status.CircuitBreaker = &CircuitBreakerStatus{State: state, ConsecutiveFailures: failures}
+	if !openedAt.IsZero() {
+		status.CircuitBreaker.LastOpened = &openedAt
+	}
+
+	return status
+}
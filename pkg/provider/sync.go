@@ -0,0 +1,242 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"github.com/waldner/external-dns-webhook-he/pkg/zonefile"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// the records a zone should have, eg those not owned by any Kubernetes resource
+type DesiredState struct {
+	Zone    string           `json:"zone"`
+	Records []*DesiredRecord `json:"records"`
+	// if set, the records matching it that are not in Records are deleted
+	Prune *PruneSelector `json:"prune,omitempty"`
+}
+
+// names are relative to the zone, unless they end with a dot or with the
+// zone name; "@" is the zone itself
+type DesiredRecord struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     int64    `json:"ttl,omitempty"`
+	Targets []string `json:"targets"`
+}
+
+// an empty list matches everything. Names are glob patterns (eg "_acme-challenge.*"),
+// written like the names of the records
+type PruneSelector struct {
+	Names []string `json:"names,omitempty"`
+	Types []string `json:"types,omitempty"`
+}
+
+// what external-dns writes in its TXT registry records
+const externalDnsHeritage = "heritage=external-dns"
+
+// in the external-dns TXT prefix or suffix, replaced by the record type
+const recordTypeTemplate = "%{record_type}"
+
+// compute the changes that bring the zone to the desired state: the records
+// in the state that are missing are created, and the records matching the
+// prune selector that are not in the state are deleted. The other records
+// with a name and type that are in the state, but not their target, are
+// left alone and returned along with the changes, so they can be shown.
+// Records owned by external-dns (those with a registry TXT record, and the
+// registry records themselves), locked records and SOA and NS records are
+// never deleted. TTLs are not compared
+func (p *Provider) SyncChanges(ctx context.Context, state *DesiredState) (*plan.Changes, []*endpoint.Endpoint, error) {
+
+	zone, err := normalizeZoneName(state.Zone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SyncChanges: %w", err)
+	}
+
+	desired, err := desiredRecords(zone, state.Records)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SyncChanges: %s", err)
+	}
+	var selector *PruneSelector
+	if state.Prune != nil {
+		selector = &PruneSelector{Types: state.Prune.Types}
+		for _, name := range state.Prune.Names {
+			selector.Names = append(selector.Names, absoluteName(name, zone))
+		}
+		for _, pattern := range selector.Names {
+			if _, err := path.Match(pattern, zone); err != nil {
+				return nil, nil, fmt.Errorf("SyncChanges: invalid name pattern '%s': %s", pattern, err)
+			}
+		}
+	}
+
+	zoneRecords, err := p.ZoneRecords(ctx, zone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SyncChanges: %w", err)
+	}
+	current := []*endpoint.Endpoint{}
+	for _, record := range zoneRecords {
+		if importableTypes[record.RecordType] {
+			current = append(current, record)
+		}
+	}
+
+	changes := diffRecords(current, desired, false)
+
+	declared := map[string]bool{}
+	for _, record := range desired {
+		declared[record.DNSName+"/"+record.RecordType] = true
+	}
+	registry := newTxtRegistry(current, p.config.TxtPrefix, p.config.TxtSuffix)
+
+	notInFile := []*endpoint.Endpoint{}
+	for _, record := range common.ExpandRecords(current) {
+		if common.IsReadOnly(record) || isRegistryRecord(record) || findRecordIndex(desired, record) >= 0 {
+			continue
+		}
+		switch {
+		case selector.matches(record) && !registry.owns(record):
+			changes.Delete = append(changes.Delete, record)
+		case declared[record.DNSName+"/"+record.RecordType]:
+			notInFile = append(notInFile, record)
+		}
+	}
+	return changes, notInFile, nil
+}
+
+// return the desired records as single-target endpoints, in the form HE returns them
+func desiredRecords(zone string, records []*DesiredRecord) ([]*endpoint.Endpoint, error) {
+
+	desired := []*endpoint.Endpoint{}
+	for _, record := range records {
+		name := absoluteName(record.Name, zone)
+		recordType := strings.ToUpper(record.Type)
+		if record.Name == "" || (name != zone && !strings.HasSuffix(name, "."+zone)) {
+			return nil, fmt.Errorf("desiredRecords: record '%s' is not in zone %s", record.Name, zone)
+		}
+		if strings.Contains(name, "*") {
+			return nil, fmt.Errorf("desiredRecords: record %s: HE doesn't allow wildcards", name)
+		}
+		if !importableTypes[recordType] {
+			return nil, fmt.Errorf("desiredRecords: record %s: type '%s' can't be managed", name, record.Type)
+		}
+		if len(record.Targets) == 0 {
+			return nil, fmt.Errorf("desiredRecords: record %s %s has no targets", name, recordType)
+		}
+		for _, target := range record.Targets {
+			switch recordType {
+			case "TXT", "SPF":
+				target = zonefile.QuoteTxt(target)
+			case "CNAME", "ALIAS", "PTR", "MX", "SRV":
+				target = strings.TrimSuffix(strings.TrimSpace(target), ".")
+			}
+			desired = append(desired, endpoint.NewEndpointWithTTL(name, recordType, endpoint.TTL(record.TTL), target))
+		}
+	}
+	return desired, nil
+}
+
+// return the name fully qualified, without the final dot
+func absoluteName(name string, zone string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch {
+	case name == "@":
+		return zone
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case name == zone || strings.HasSuffix(name, "."+zone):
+		return name
+	}
+	return name + "." + zone
+}
+
+// a nil selector matches nothing
+func (s *PruneSelector) matches(record *endpoint.Endpoint) bool {
+
+	if s == nil {
+		return false
+	}
+	if len(s.Types) > 0 {
+		found := false
+		for _, t := range s.Types {
+			found = found || strings.EqualFold(t, record.RecordType)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(s.Names) == 0 {
+		return true
+	}
+	for _, pattern := range s.Names {
+		if ok, _ := path.Match(pattern, record.DNSName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isRegistryRecord(record *endpoint.Endpoint) bool {
+	return record.RecordType == "TXT" && strings.Contains(record.Targets[0], externalDnsHeritage)
+}
+
+// the names of the external-dns registry records in a zone
+type txtRegistry struct {
+	prefix string
+	suffix string
+	names  map[string]bool
+}
+
+// prefix and suffix are those given to external-dns with --txt-prefix
+// and --txt-suffix
+func newTxtRegistry(records []*endpoint.Endpoint, prefix string, suffix string) *txtRegistry {
+
+	registry := &txtRegistry{
+		prefix: strings.ToLower(prefix),
+		suffix: strings.ToLower(suffix),
+		names:  map[string]bool{},
+	}
+	for _, record := range common.ExpandRecords(records) {
+		if isRegistryRecord(record) {
+			registry.names[strings.ToLower(record.DNSName)] = true
+		}
+	}
+	return registry
+}
+
+// return whether external-dns has a registry record for the record, with
+// either the name it used to give them or the current one, which includes
+// the record type
+func (r *txtRegistry) owns(record *endpoint.Endpoint) bool {
+
+	name := strings.ToLower(record.DNSName)
+	recordType := strings.ToLower(record.RecordType)
+
+	// old name: the affixes without the record type
+	oldName := registryName(name, strings.ReplaceAll(r.prefix, recordTypeTemplate, ""), strings.ReplaceAll(r.suffix, recordTypeTemplate, ""))
+
+	// current name: the record type goes where the affixes say, or in front
+	// of the first label (eg "a-www.example.com"). For the apex this is out
+	// of the zone, so external-dns only finds the old one there
+	prefix := strings.ReplaceAll(r.prefix, recordTypeTemplate, recordType)
+	suffix := strings.ReplaceAll(r.suffix, recordTypeTemplate, recordType)
+	if !strings.Contains(r.prefix+r.suffix, recordTypeTemplate) {
+		prefix += recordType + "-"
+	}
+	newName := registryName(name, prefix, suffix)
+
+	return r.names[oldName] || r.names[newName]
+}
+
+// like external-dns, the affixes wrap the first label of the name
+func registryName(name string, prefix string, suffix string) string {
+	label, rest, found := strings.Cut(name, ".")
+	if !found {
+		return prefix + label + suffix
+	}
+	return prefix + label + suffix + "." + rest
+}
@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+const (
+	opCreate = "create"
+	opDelete = "delete"
+	opUpdate = "update"
+)
+
+// a single record operation that has been successfully performed on HE
+type operation struct {
+	action   string
+	zone     string
+	zoneData *common.ZoneData
+	record   *endpoint.Endpoint
+	// for updates, the record before the change
+	previous *endpoint.Endpoint
+}
+
+func (o *operation) String() string {
+	return fmt.Sprintf("%s %s (zone %s)", o.action, o.record, o.zone)
+}
+
+// a transaction keeps track of all the operations done during an
+// ApplyChanges, so they can be undone if something fails midway
+type transaction struct {
+	client ClientService
+	done   []*operation
+}
+
+func newTransaction(client ClientService) *transaction {
+	return &transaction{
+		client: client,
+		done:   []*operation{},
+	}
+}
+
+func (t *transaction) add(action string, zone string, zoneData *common.ZoneData, record *endpoint.Endpoint, previous *endpoint.Endpoint) {
+	t.done = append(t.done, &operation{
+		action:   action,
+		zone:     zone,
+		zoneData: zoneData,
+		record:   record,
+		previous: previous,
+	})
+}
+
+// undo all the recorded operations, most recent first. Operations that
+// cannot be undone are logged, and returned in the error
+func (t *transaction) rollback(ctx context.Context) error {
+
+	log.Warnf("Rolling back %d already applied operations", len(t.done))
+
+	failed := []string{}
+	for i := len(t.done) - 1; i >= 0; i-- {
+		op := t.done[i]
+		records := []*endpoint.Endpoint{op.record}
+
+		var err error
+		switch op.action {
+		case opCreate:
+			err = t.client.DeleteRecords(ctx, op.zone, op.zoneData, records)
+		case opDelete:
+			err = t.client.CreateRecords(ctx, op.zone, op.zoneData, records)
+		case opUpdate:
+			// the previous record has the same ID, so this restores it
+			err = t.client.UpdateRecords(ctx, op.zone, op.zoneData, []*endpoint.Endpoint{op.previous})
+		}
+
+		if err != nil {
+			log.Errorf("Rollback: cannot undo operation '%s': %s", op, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", op, err))
+			continue
+		}
+		log.Infof("Rollback: undone operation '%s'", op)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("rollback incomplete, %d of %d operations could not be undone: %s", len(failed), len(t.done), strings.Join(failed, "; "))
+	}
+
+	log.Infof("Rollback: successfully undone %d operations", len(t.done))
+	return nil
+}
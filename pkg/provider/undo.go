@@ -0,0 +1,185 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/audit"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+var ErrBatchNotFound = errors.New("batch not found in the audit log")
+
+// return the ID of the most recent batch that changed something
+func (p *Provider) LastBatchId() (string, error) {
+
+	entries, err := p.AuditEntries(&audit.Filter{})
+	if err != nil {
+		return "", fmt.Errorf("LastBatchId: %w", err)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].BatchId != "" && entries[i].Outcome == audit.OutcomeSuccess {
+			return entries[i].BatchId, nil
+		}
+	}
+	return "", fmt.Errorf("LastBatchId: %w", ErrBatchNotFound)
+}
+
+// the net effect of a batch on the targets of a name and type
+type netChange struct {
+	name       string
+	recordType string
+	// target there after the batch -> target it replaced, "" if it was created
+	added map[string]string
+	// targets there before the batch and gone after it
+	removed map[string]bool
+	ttls    map[string]endpoint.TTL
+}
+
+func newNetChange(name string, recordType string) *netChange {
+	return &netChange{
+		name:       name,
+		recordType: recordType,
+		added:      map[string]string{},
+		removed:    map[string]bool{},
+		ttls:       map[string]endpoint.TTL{},
+	}
+}
+
+func (n *netChange) create(target string) {
+	if n.removed[target] {
+		delete(n.removed, target)
+		return
+	}
+	n.added[target] = ""
+}
+
+func (n *netChange) delete(target string) {
+	if original, ok := n.added[target]; ok {
+		delete(n.added, target)
+		if original != "" {
+			n.removed[original] = true
+		}
+		return
+	}
+	n.removed[target] = true
+}
+
+func (n *netChange) update(previous string, target string) {
+	original := previous
+	if o, ok := n.added[previous]; ok {
+		original = o
+		delete(n.added, previous)
+	}
+	switch {
+	case n.removed[target]:
+		delete(n.removed, target)
+		if original != "" {
+			n.removed[original] = true
+		}
+	case original != target:
+		n.added[target] = original
+	}
+}
+
+// an update whose previous target is unknown, like those done by a rollback,
+// can only be accounted for if it puts back a target replaced earlier
+func (n *netChange) revert(target string) bool {
+	for added, original := range n.added {
+		if original == target {
+			delete(n.added, added)
+			return true
+		}
+	}
+	return false
+}
+
+// compute the changes that revert what the batch did, from its audit log
+// entries: created records are deleted, deleted records are created, and
+// updated records get their previous target back. The entries are first
+// reduced to their net effect on each name, type and target, so that
+// operations undone later in the same batch (eg by a rollback) are not
+// reverted. Only the operations that succeeded count; those that can't be
+// reverted (updates whose previous target is unknown) are returned along
+// with the changes
+func (p *Provider) InverseChanges(batchId string) (*plan.Changes, []*audit.Entry, error) {
+
+	entries, err := p.AuditEntries(&audit.Filter{BatchId: batchId})
+	if err != nil {
+		return nil, nil, fmt.Errorf("InverseChanges: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil, fmt.Errorf("InverseChanges: %w: %s", ErrBatchNotFound, batchId)
+	}
+
+	// in the order they were first touched
+	netChanges := []*netChange{}
+	byKey := map[string]*netChange{}
+	notInvertible := []*audit.Entry{}
+
+	for _, entry := range entries {
+		if entry.Outcome != audit.OutcomeSuccess {
+			continue
+		}
+		key := entry.Name + "/" + entry.Type
+		net, ok := byKey[key]
+		if !ok {
+			net = newNetChange(entry.Name, entry.Type)
+			byKey[key] = net
+			netChanges = append(netChanges, net)
+		}
+		for i, target := range entry.Targets {
+			switch entry.Action {
+			case audit.ActionCreate:
+				net.create(target)
+			case audit.ActionDelete:
+				net.delete(target)
+			case audit.ActionUpdate:
+				if i >= len(entry.PreviousTargets) {
+					if !net.revert(target) {
+						notInvertible = append(notInvertible, entry)
+					}
+					continue
+				}
+				net.update(entry.PreviousTargets[i], target)
+				net.ttls[entry.PreviousTargets[i]] = endpoint.TTL(entry.TTL)
+			}
+			net.ttls[target] = endpoint.TTL(entry.TTL)
+		}
+	}
+
+	changes := &plan.Changes{
+		Create:    []*endpoint.Endpoint{},
+		UpdateOld: []*endpoint.Endpoint{},
+		UpdateNew: []*endpoint.Endpoint{},
+		Delete:    []*endpoint.Endpoint{},
+	}
+	for _, net := range netChanges {
+		added := []string{}
+		for target := range net.added {
+			added = append(added, target)
+		}
+		sort.Strings(added)
+		for _, target := range added {
+			original := net.added[target]
+			ttl := net.ttls[target]
+			if original == "" {
+				changes.Delete = append(changes.Delete, endpoint.NewEndpointWithTTL(net.name, net.recordType, ttl, target))
+				continue
+			}
+			changes.UpdateOld = append(changes.UpdateOld, endpoint.NewEndpointWithTTL(net.name, net.recordType, ttl, target))
+			changes.UpdateNew = append(changes.UpdateNew, endpoint.NewEndpointWithTTL(net.name, net.recordType, ttl, original))
+		}
+		removed := []string{}
+		for target := range net.removed {
+			removed = append(removed, target)
+		}
+		sort.Strings(removed)
+		for _, target := range removed {
+			changes.Create = append(changes.Create, endpoint.NewEndpointWithTTL(net.name, net.recordType, net.ttls[target], target))
+		}
+	}
+	return changes, notInvertible, nil
+}
@@ -0,0 +1,199 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+var zoneNameRegexp = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// return the zone name in the form HE uses, or an error if it's not valid
+func normalizeZoneName(zone string) (string, error) {
+	zone = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(zone)), ".")
+	if len(zone) > 253 || !zoneNameRegexp.MatchString(zone) {
+		return "", fmt.Errorf("%w: '%s'", ErrInvalidZoneName, zone)
+	}
+	return zone, nil
+}
+
+// create a zone in the HE account. The next operations see it
+// right away, as the zone list is read again at every login
+func (p *Provider) AddZone(ctx context.Context, zone string) error {
+
+	zone, err := normalizeZoneName(zone)
+	if err != nil {
+		return fmt.Errorf("AddZone: %w", err)
+	}
+	if !p.domainFilter.Match(zone) {
+		log.Warnf("AddZone: zone %s does not match the domain filter, its records won't be managed", zone)
+	}
+
+	ctx, cancel := p.operationContext(ctx)
+	defer cancel()
+
+	err = p.client.DoLogin(ctx)
+	if err != nil {
+		return fmt.Errorf("AddZone: %s", err)
+	}
+
+	defer p.client.DoLogout(context.WithoutCancel(ctx))
+
+	zones, err := p.client.GetMatchingZones(ctx, p.domainFilter)
+	if err != nil {
+		return fmt.Errorf("AddZone: %s", err)
+	}
+	if _, ok := zones[zone]; ok {
+		return fmt.Errorf("AddZone: %w: %s", ErrZoneExists, zone)
+	}
+
+	err = p.client.AddZone(ctx, zone)
+	// even if it failed, we don't know what the zone list looks like now
+	p.cache.invalidateZones()
+	if err != nil {
+		return fmt.Errorf("AddZone: %s", err)
+	}
+	return nil
+}
+
+// delete a zone and all its records from the HE account. This must be explicitly
+// enabled, and only works on zones that match the domain filter
+func (p *Provider) DeleteZone(ctx context.Context, zone string) error {
+
+	if !p.allowZoneDeletion {
+		return fmt.Errorf("DeleteZone: %w", ErrZoneDeletionDisabled)
+	}
+
+	zone, err := normalizeZoneName(zone)
+	if err != nil {
+		return fmt.Errorf("DeleteZone: %w", err)
+	}
+
+	ctx, cancel := p.operationContext(ctx)
+	defer cancel()
+
+	err = p.client.DoLogin(ctx)
+	if err != nil {
+		return fmt.Errorf("DeleteZone: %s", err)
+	}
+
+	defer p.client.DoLogout(context.WithoutCancel(ctx))
+
+	zones, err := p.client.GetMatchingZones(ctx, p.domainFilter)
+	if err != nil {
+		return fmt.Errorf("DeleteZone: %s", err)
+	}
+	zoneData, ok := zones[zone]
+	if !ok {
+		return fmt.Errorf("DeleteZone: %w among the managed zones: %s", ErrZoneNotFound, zone)
+	}
+
+	log.Warnf("DeleteZone: deleting zone %s and all its records", zone)
+	err = p.client.DeleteZone(ctx, zone, zoneData)
+	p.cache.invalidateZones()
+	p.cache.invalidate(zone)
+	if err != nil {
+		return fmt.Errorf("DeleteZone: %s", err)
+	}
+	return nil
+}
+
+// return the names of the zones in the HE account that match the domain filter, sorted
+func (p *Provider) ManagedZones(ctx context.Context) ([]string, error) {
+
+	ctx, cancel := p.operationContext(ctx)
+	defer cancel()
+
+	err := p.client.DoLogin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ManagedZones: %s", err)
+	}
+
+	defer p.client.DoLogout(context.WithoutCancel(ctx))
+
+	zones, err := p.client.GetMatchingZones(ctx, p.domainFilter)
+	if err != nil {
+		return nil, fmt.Errorf("ManagedZones: %s", err)
+	}
+
+	names := []string{}
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// return the current records of a managed zone, read from HE
+func (p *Provider) ZoneRecords(ctx context.Context, zone string) ([]*endpoint.Endpoint, error) {
+
+	if strings.TrimSpace(zone) == "" {
+		return nil, fmt.Errorf("ZoneRecords: %w: '%s'", ErrInvalidZoneName, zone)
+	}
+	zones, err := p.ExportZones(ctx, zone)
+	if err != nil {
+		return nil, fmt.Errorf("ZoneRecords: %w", err)
+	}
+	for _, endpoints := range zones {
+		return endpoints, nil
+	}
+	return nil, fmt.Errorf("ZoneRecords: %w among the managed zones: %s", ErrZoneNotFound, zone)
+}
+
+// return the current records of a managed zone, or of all of them if zone is
+// empty, read from HE. Unlike GetAllRecords, it fails if any zone can't be read
+func (p *Provider) ExportZones(ctx context.Context, zone string) (map[string][]*endpoint.Endpoint, error) {
+
+	if zone != "" {
+		var err error
+		zone, err = normalizeZoneName(zone)
+		if err != nil {
+			return nil, fmt.Errorf("ExportZones: %w", err)
+		}
+	}
+
+	ctx, cancel := p.operationContext(ctx)
+	defer cancel()
+
+	err := p.client.DoLogin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ExportZones: %s", err)
+	}
+
+	defer p.client.DoLogout(context.WithoutCancel(ctx))
+
+	zones, err := p.client.GetMatchingZones(ctx, p.domainFilter)
+	if err != nil {
+		return nil, fmt.Errorf("ExportZones: %s", err)
+	}
+
+	names := []string{}
+	for name := range zones {
+		if zone == "" || name == zone {
+			names = append(names, name)
+		}
+	}
+	if zone != "" && len(names) == 0 {
+		return nil, fmt.Errorf("ExportZones: %w among the managed zones: %s", ErrZoneNotFound, zone)
+	}
+	sort.Strings(names)
+
+	// a backup must not come from the cache
+	for _, name := range names {
+		p.cache.invalidate(name)
+	}
+
+	exported := map[string][]*endpoint.Endpoint{}
+	for i, result := range p.readZones(ctx, names, zones) {
+		if result.err != nil {
+			return nil, fmt.Errorf("ExportZones: zone %s: %s", names[i], result.err)
+		}
+		exported[names[i]] = result.endpoints
+	}
+	return exported, nil
+}
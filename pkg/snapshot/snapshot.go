@@ -0,0 +1,185 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+const timeFormat = "20060102T150405.000Z"
+
+var ErrNotFound = errors.New("snapshot not found")
+
+// the contents of a zone at a point in time
+type Snapshot struct {
+	Zone string    `json:"zone"`
+	Time time.Time `json:"time"`
+	// the batch of changes that was about to be applied
+	BatchId   string               `json:"batchId,omitempty"`
+	Endpoints []*endpoint.Endpoint `json:"endpoints"`
+}
+
+// Store keeps the snapshots in a directory, one subdirectory per zone and
+// one JSON file per snapshot. After each new snapshot, those beyond maxPerZone
+// or older than maxAge are deleted (0 means no limit). A nil Store saves nothing
+type Store struct {
+	dir        string
+	maxPerZone int
+	maxAge     time.Duration
+	mutex      sync.Mutex
+}
+
+// return a store in dir, or nil if dir is empty
+func NewStore(dir string, maxPerZone int, maxAge time.Duration) (*Store, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("NewStore: cannot create snapshot directory: %s", err)
+	}
+	return &Store{dir: dir, maxPerZone: maxPerZone, maxAge: maxAge}, nil
+}
+
+func (s *Store) zoneDir(zone string) string {
+	return filepath.Join(s.dir, zone)
+}
+
+// save the zone records, and return the name of the snapshot
+func (s *Store) Save(zone string, batchId string, endpoints []*endpoint.Endpoint) (string, error) {
+
+	snapshot := &Snapshot{
+		Zone:      zone,
+		Time:      time.Now().UTC(),
+		BatchId:   batchId,
+		Endpoints: endpoints,
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(s.zoneDir(zone), 0o700); err != nil {
+		return "", fmt.Errorf("Save: %s", err)
+	}
+
+	// two snapshots of a zone in the same millisecond must not overwrite each other
+	name := snapshot.Time.Format(timeFormat)
+	path := filepath.Join(s.zoneDir(zone), name+".json")
+	for {
+		if _, err := os.Stat(path); err != nil {
+			break
+		}
+		snapshot.Time = snapshot.Time.Add(time.Millisecond)
+		name = snapshot.Time.Format(timeFormat)
+		path = filepath.Join(s.zoneDir(zone), name+".json")
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("Save: %s", err)
+	}
+
+	// write and rename, so that a snapshot is either complete or not there
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return "", fmt.Errorf("Save: %s", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", fmt.Errorf("Save: %s", err)
+	}
+
+	s.prune(zone)
+	return name, nil
+}
+
+// delete the snapshots of the zone beyond the retention limits
+func (s *Store) prune(zone string) {
+
+	names, err := s.List(zone)
+	if err != nil {
+		log.Warnf("prune: %s", err)
+		return
+	}
+
+	for i, name := range names {
+		keep := s.maxPerZone <= 0 || i >= len(names)-s.maxPerZone
+		if keep && s.maxAge > 0 {
+			if t, err := time.Parse(timeFormat, name); err == nil && time.Since(t) > s.maxAge {
+				keep = false
+			}
+		}
+		// never delete the most recent one
+		if keep || i == len(names)-1 {
+			continue
+		}
+		log.Debugf("prune: deleting snapshot %s of zone %s", name, zone)
+		if err := os.Remove(filepath.Join(s.zoneDir(zone), name+".json")); err != nil {
+			log.Warnf("prune: %s", err)
+		}
+	}
+}
+
+// return the names of the snapshots of the zone, oldest first
+func (s *Store) List(zone string) ([]string, error) {
+
+	files, err := os.ReadDir(s.zoneDir(zone))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("List: %s", err)
+	}
+
+	names := []string{}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok || file.IsDir() {
+			continue
+		}
+		names = append(names, name)
+	}
+	// the names are timestamps
+	sort.Strings(names)
+	return names, nil
+}
+
+// load a snapshot of the zone; an empty name means the most recent one
+func (s *Store) Load(zone string, name string) (*Snapshot, error) {
+
+	if name == "" {
+		names, err := s.List(zone)
+		if err != nil {
+			return nil, fmt.Errorf("Load: %s", err)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("Load: %w for zone %s", ErrNotFound, zone)
+		}
+		name = names[len(names)-1]
+	}
+
+	// the name comes from the user, don't let it point elsewhere
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("Load: invalid snapshot name '%s'", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.zoneDir(zone), name+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Load: %w: %s/%s", ErrNotFound, zone, name)
+		}
+		return nil, fmt.Errorf("Load: %s", err)
+	}
+
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("Load: invalid snapshot %s/%s: %s", zone, name, err)
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,99 @@
+package snapshot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestRetention(t *testing.T) {
+
+	dir := t.TempDir()
+	store, err := NewStore(dir, 3, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewStore should not have failed, but got: %s", err)
+	}
+
+	// older than the maximum age
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(timeFormat)
+	os.MkdirAll(filepath.Join(dir, "foo.bar"), 0o700)
+	os.WriteFile(filepath.Join(dir, "foo.bar", old+".json"), []byte("{}"), 0o600)
+
+	saved := []string{}
+	for i := 0; i < 5; i++ {
+		if i == 1 {
+			if names, _ := store.List("foo.bar"); len(names) != 1 || names[0] == old {
+				t.Errorf("List: got %v, wanted the old snapshot to be deleted", names)
+			}
+		}
+		name, err := store.Save("foo.bar", "batch", []*endpoint.Endpoint{endpoint.NewEndpoint("a.foo.bar", "A", "1.1.1.1")})
+		if err != nil {
+			t.Fatalf("Save should not have failed, but got: %s", err)
+		}
+		saved = append(saved, name)
+	}
+
+	names, err := store.List("foo.bar")
+	if err != nil {
+		t.Fatalf("List should not have failed, but got: %s", err)
+	}
+	if len(names) != 3 || names[0] != saved[2] || names[2] != saved[4] {
+		t.Errorf("List: got %v, wanted the last 3 of %v", names, saved)
+	}
+
+	// the most recent one is kept, however old
+	store, _ = NewStore(dir, 0, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	last, _ := store.Save("foo.baz", "", []*endpoint.Endpoint{})
+	time.Sleep(time.Millisecond)
+	store.prune("foo.baz")
+	if names, _ := store.List("foo.baz"); len(names) != 1 || names[0] != last {
+		t.Errorf("List: got %v, wanted only %s", names, last)
+	}
+
+	// a nil store is what an empty directory gives
+	if store, err := NewStore("", 3, 0); store != nil || err != nil {
+		t.Errorf("NewStore: expected no store and no error for an empty directory")
+	}
+}
+
+func TestLoad(t *testing.T) {
+
+	store, err := NewStore(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("NewStore should not have failed, but got: %s", err)
+	}
+
+	if _, err := store.Load("foo.bar", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load: expected a not found error, got %v", err)
+	}
+
+	first, _ := store.Save("foo.bar", "batch1", []*endpoint.Endpoint{endpoint.NewEndpoint("a.foo.bar", "A", "1.1.1.1")})
+	store.Save("foo.bar", "batch2", []*endpoint.Endpoint{endpoint.NewEndpoint("a.foo.bar", "A", "1.1.1.2")})
+
+	latest, err := store.Load("foo.bar", "")
+	if err != nil {
+		t.Fatalf("Load should not have failed, but got: %s", err)
+	}
+	if latest.BatchId != "batch2" || len(latest.Endpoints) != 1 || latest.Endpoints[0].Targets[0] != "1.1.1.2" {
+		t.Errorf("Load: got %+v, wanted the second snapshot", latest)
+	}
+
+	snapshot, err := store.Load("foo.bar", first)
+	if err != nil {
+		t.Fatalf("Load should not have failed, but got: %s", err)
+	}
+	if snapshot.BatchId != "batch1" || snapshot.Zone != "foo.bar" {
+		t.Errorf("Load: got %+v, wanted the first snapshot", snapshot)
+	}
+
+	for _, name := range []string{"../foo.baz/" + first, "..", "missing"} {
+		if _, err := store.Load("foo.bar", name); err == nil {
+			t.Errorf("Load should have failed for '%s'", name)
+		}
+	}
+}
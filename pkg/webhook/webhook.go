@@ -1,12 +1,23 @@
 package webhook
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	log "github.com/sirupsen/logrus"
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"github.com/waldner/external-dns-webhook-he/pkg/metrics"
 	"github.com/waldner/external-dns-webhook-he/pkg/provider"
+	"github.com/waldner/external-dns-webhook-he/pkg/zonefile"
 	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/plan"
 )
@@ -16,16 +27,21 @@ type Webhook struct {
 }
 
 const (
-	contentTypeValue = "application/external.dns.webhook+json;version=1"
+	contentTypeValue   = "application/external.dns.webhook+json;version=1"
+	skippedZonesHeader = "X-Webhook-Skipped-Zones"
+	requestIdHeader    = "X-Request-Id"
+	maxRequestIdLength = 128
 )
 
 func NewWebhook(provider *provider.Provider) (*Webhook, error) {
 	return &Webhook{provider}, nil
 }
 
+// liveness: only says that the process is serving requests, HE is not
+// contacted. /health is kept for existing deployments
 func Health(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/health" {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/health" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -33,6 +49,68 @@ func Health(next http.Handler) http.Handler {
 	})
 }
 
+// readiness: whether HE can be used, see Provider.CheckReadiness
+func (h *Webhook) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := h.provider.CheckReadiness(r.Context()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: %s\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// give each request an ID, taken from the X-Request-Id header if present,
+// so that the record changes it causes can be found in the audit log
+func RequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(requestIdHeader)
+		if requestId == "" || len(requestId) > maxRequestIdLength {
+			requestId = common.NewId()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+		next.ServeHTTP(w, r.WithContext(common.WithRequestId(r.Context(), requestId)))
+	})
+}
+
+// the admin endpoints require the token as a bearer token, if one is configured
+func AdminAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token != "" {
+				got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					writeError(w, "missing or invalid admin token", http.StatusUnauthorized)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// count the requests and their latency. Requests are labeled with the
+// route pattern rather than the path, so /zones/{zone} is a single route
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.HttpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		metrics.HttpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
 // return domain filter
 func (h *Webhook) Negotiate(w http.ResponseWriter, r *http.Request) {
 
@@ -70,13 +148,17 @@ func (h *Webhook) Records(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	endpoints, err := h.provider.GetAllRecords()
+	endpoints, skippedZones, err := h.provider.GetAllRecords(r.Context())
 	if err != nil {
 		log.Errorf("Records: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	log.Infof("Found %d records", len(endpoints))
+	if len(skippedZones) > 0 {
+		log.Warnf("Records: returning partial results, skipped zones: %s", strings.Join(skippedZones, ","))
+		w.Header().Set(skippedZonesHeader, strings.Join(skippedZones, ","))
+	}
 	w.Header().Set("Content-Type", contentTypeValue)
 	w.Header().Set("Vary", "Content-Type")
 	err = json.NewEncoder(w).Encode(endpoints)
@@ -162,7 +244,7 @@ func (h *Webhook) ApplyChanges(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.provider.ApplyChanges(&changes)
+	err = h.provider.ApplyChanges(r.Context(), &changes)
 	if err != nil {
 		log.Errorf("ApplyChanges: %s", err)
 		w.Header().Set("Content-Type", "text/plain")
@@ -172,6 +254,120 @@ func (h *Webhook) ApplyChanges(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// POST to /cache/flush
+// forget all cached zones and records, so the next read goes to HE
+func (h *Webhook) FlushCache(w http.ResponseWriter, r *http.Request) {
+
+	log.Debugf("******************** Received request in FlushCache: %+v", r)
+	h.provider.FlushCache()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET to /status, returns the state of the webhook as JSON
+func (h *Webhook) Status(version string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := struct {
+			Version string `json:"version"`
+			*provider.Status
+		}{version, h.provider.Status()}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(&status); err != nil {
+			log.Errorf("Status: error writing response: %s", err)
+		}
+	}
+}
+
+// POST to /zones, with {"zone": "example.com"}
+// create a new zone on HE
+func (h *Webhook) AddZone(w http.ResponseWriter, r *http.Request) {
+
+	log.Debugf("******************** Received request in AddZone: %+v", r)
+
+	request := struct {
+		Zone string `json:"zone"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Errorf("AddZone: error decoding request body JSON: %s", err)
+		writeError(w, fmt.Sprintf("error decoding request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	err := h.provider.AddZone(r.Context(), request.Zone)
+	if err != nil {
+		log.Errorf("AddZone: %s", err)
+		writeError(w, err.Error(), zoneErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// DELETE to /zones/{zone}
+// delete a zone from HE, if zone deletion is enabled
+func (h *Webhook) DeleteZone(w http.ResponseWriter, r *http.Request) {
+
+	log.Debugf("******************** Received request in DeleteZone: %+v", r)
+
+	err := h.provider.DeleteZone(r.Context(), chi.URLParam(r, "zone"))
+	if err != nil {
+		log.Errorf("DeleteZone: %s", err)
+		writeError(w, err.Error(), zoneErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET to /export?format=bind|json|csv[&zone=example.com]
+// return the records of one or all managed zones, read from HE
+func (h *Webhook) Export(w http.ResponseWriter, r *http.Request) {
+
+	log.Debugf("******************** Received request in Export: %+v", r)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = zonefile.FormatBind
+	}
+	if !zonefile.IsFormat(format) {
+		writeError(w, fmt.Sprintf("unknown format '%s', must be one of bind, json, csv", format), http.StatusBadRequest)
+		return
+	}
+
+	zones, err := h.provider.ExportZones(r.Context(), r.URL.Query().Get("zone"))
+	if err != nil {
+		log.Errorf("Export: %s", err)
+		writeError(w, err.Error(), zoneErrorStatus(err))
+		return
+	}
+
+	// write to a buffer first, so that a failure still gets an error status
+	var buf bytes.Buffer
+	if err := zonefile.Export(&buf, format, zones); err != nil {
+		log.Errorf("Export: %s", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", zonefile.ContentType(format))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Errorf("Export: error writing response: %s", err)
+	}
+}
+
+func zoneErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, provider.ErrInvalidZoneName):
+		return http.StatusBadRequest
+	case errors.Is(err, provider.ErrZoneDeletionDisabled):
+		return http.StatusForbidden
+	case errors.Is(err, provider.ErrZoneNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, provider.ErrZoneExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 // check that the given header is "application/external.dns.webhook+json;version=1"
 func checkHeader(w http.ResponseWriter, r *http.Request, headerName string) error {
 
@@ -5,10 +5,14 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/waldner/external-dns-webhook-he/pkg/client"
 	"github.com/waldner/external-dns-webhook-he/pkg/common"
 	"github.com/waldner/external-dns-webhook-he/pkg/config"
+	"github.com/waldner/external-dns-webhook-he/pkg/metrics"
 	"github.com/waldner/external-dns-webhook-he/pkg/provider"
 	"sigs.k8s.io/external-dns/endpoint"
 
@@ -114,7 +118,7 @@ func testRecords(t *testing.T, hook *Webhook, provider *provider.Provider) {
 
 	wanted := []*endpoint.Endpoint{}
 	for _, zone := range matchingZones(provider.DomainFilter()) {
-		wanted = append(wanted, common.ExpandRecords(common.TestData[zone].Endpoints)...)
+		wanted = append(wanted, common.AggregateRecords(common.TestData[zone].Endpoints)...)
 	}
 	if !common.SameEndpoints(wanted, records) {
 		t.Errorf("/records: received record set %v differs from wanted %v", records, wanted)
@@ -164,8 +168,8 @@ func testAdjustEndpoints(t *testing.T, hook *Webhook, testCase *common.TestCase)
 		}
 	}
 
-	if !common.SameEndpoints(common.ExpandRecords(testCase.AdjustEndpointsInput), records) {
-		t.Errorf("/adjustendpoints: received record set %v differs from wanted %v", records, common.ExpandRecords(testCase.AdjustEndpointsInput))
+	if !common.SameEndpoints(common.AggregateRecords(testCase.AdjustEndpointsInput), records) {
+		t.Errorf("/adjustendpoints: received record set %v differs from wanted %v", records, common.AggregateRecords(testCase.AdjustEndpointsInput))
 	}
 }
 
@@ -213,3 +217,316 @@ func matchingZones(domainFilter *endpoint.DomainFilter) []string {
 	}
 	return zones
 }
+
+func TestRecordsSkippedZones(t *testing.T) {
+
+	domainFilter := common.CreateDomainFilter("", "", []string{"foo.bar", "foo.baz"}, nil)
+	config := config.Config{}
+	mockClient := client.NewMockClient(&config)
+	mockClient.SetFailure("GetZoneEndpoints:foo.baz")
+	provider, _ := provider.NewProvider(mockClient, domainFilter, &config)
+	hook, _ := NewWebhook(provider)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/records", nil)
+	req.Header.Set("Accept", contentTypeValue)
+	http.HandlerFunc(hook.Records).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("/records handler returned wrong status code: got %d want %d", status, http.StatusOK)
+	}
+	if skipped := rr.Header().Get(skippedZonesHeader); skipped != "foo.baz" {
+		t.Errorf("/records: unexpected %s header: '%s'", skippedZonesHeader, skipped)
+	}
+}
+
+func TestZoneEndpoints(t *testing.T) {
+
+	domainFilter := common.CreateDomainFilter("", "", []string{"foo.bar", "new.example"}, nil)
+	provider := provider.NewMockProvider(&config.Config{}, domainFilter)
+	hook, err := NewWebhook(provider)
+	if err != nil {
+		t.Fatalf("Failure creating webHook: %s", err)
+	}
+
+	r := chi.NewRouter()
+	r.Post("/zones", hook.AddZone)
+	r.Delete("/zones/{zone}", hook.DeleteZone)
+
+	for _, test := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/zones", `{"zone": "new.example"}`, http.StatusCreated},
+		{"POST", "/zones", `{"zone": "new.example"}`, http.StatusConflict},
+		{"POST", "/zones", `{"zone": "not a zone"}`, http.StatusBadRequest},
+		{"POST", "/zones", `not json`, http.StatusBadRequest},
+		{"DELETE", "/zones/new.example", "", http.StatusForbidden},
+	} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(test.method, test.path, bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s %s (%s): got status %d, wanted %d", test.method, test.path, test.body, rr.Code, test.status)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	domainFilter := common.CreateDomainFilter("", "", []string{"foo.bar"}, nil)
+	provider := provider.NewMockProvider(&config.Config{}, domainFilter)
+	hook, err := NewWebhook(provider)
+	if err != nil {
+		t.Fatalf("Failure creating webHook: %s", err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(Health)
+	r.Use(Metrics)
+	r.Get("/records", hook.Records)
+	r.Delete("/zones/{zone}", hook.DeleteZone)
+	r.Handle("/metrics", metrics.Handler())
+
+	for _, request := range []struct {
+		method string
+		path   string
+		header string
+	}{
+		{"GET", "/records", "Accept"},
+		{"DELETE", "/zones/foo.bar", ""},
+		{"GET", "/nothing/here", ""},
+	} {
+		req, err := http.NewRequest(request.method, request.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if request.header != "" {
+			req.Header.Set(request.header, contentTypeValue)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/metrics: got status %d, wanted %d", rr.Code, http.StatusOK)
+	}
+
+	body := rr.Body.String()
+	for _, expected := range []string{
+		`he_webhook_http_requests_total{method="GET",route="/records",status="200"}`,
+		// the route pattern, not the path
+		`he_webhook_http_requests_total{method="DELETE",route="/zones/{zone}",status="403"}`,
+		`he_webhook_http_requests_total{method="GET",route="unmatched",status="404"}`,
+		`he_webhook_http_request_duration_seconds_count{method="GET",route="/records"}`,
+		`he_webhook_zone_records{zone="foo.bar"}`,
+		`he_webhook_last_success_timestamp_seconds{operation="GetAllRecords"}`,
+		`he_webhook_operation_he_requests{operation="GetAllRecords"}`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("/metrics: %s not found in output", expected)
+		}
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+
+	for _, test := range []struct {
+		domain string
+		path   string
+		status int
+	}{
+		{"foo.bar", "/healthz", http.StatusOK},
+		{"foo.bar", "/health", http.StatusOK},
+		{"foo.bar", "/readyz", http.StatusOK},
+		// liveness doesn't depend on HE
+		{"nothing.here", "/healthz", http.StatusOK},
+		{"nothing.here", "/readyz", http.StatusServiceUnavailable},
+	} {
+		domainFilter := common.CreateDomainFilter("", "", []string{test.domain}, nil)
+		hook, err := NewWebhook(provider.NewMockProvider(&config.Config{}, domainFilter))
+		if err != nil {
+			t.Fatalf("Failure creating webHook: %s", err)
+		}
+
+		r := chi.NewRouter()
+		r.Use(Health)
+		r.Get("/readyz", hook.Readyz)
+
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s (filter %s): got status %d, wanted %d", test.path, test.domain, rr.Code, test.status)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+
+	domainFilter := common.CreateDomainFilter("", "", []string{"foo.bar"}, nil)
+	hook, err := NewWebhook(provider.NewMockProvider(&config.Config{Password: "secret"}, domainFilter))
+	if err != nil {
+		t.Fatalf("Failure creating webHook: %s", err)
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Status("1.2.3")(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/status: got status %d, wanted %d", rr.Code, http.StatusOK)
+	}
+
+	var status map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("/status: invalid JSON: %s", err)
+	}
+	if status["version"] != "1.2.3" {
+		t.Errorf("/status: got version %v, wanted 1.2.3", status["version"])
+	}
+	for _, key := range []string{"config", "domainFilter", "zones", "operations", "recentErrors", "rateLimiter", "circuitBreaker"} {
+		if _, ok := status[key]; !ok {
+			t.Errorf("/status: %s missing", key)
+		}
+	}
+	if strings.Contains(rr.Body.String(), "secret") {
+		t.Errorf("/status: the password should not be shown")
+	}
+}
+
+func TestRequestId(t *testing.T) {
+
+	var seen []string
+	handler := RequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = common.RequestIds(r.Context())
+	}))
+
+	for _, test := range []struct {
+		header    string
+		generated bool
+	}{
+		{"abc123", false},
+		{"", true},
+		{strings.Repeat("x", maxRequestIdLength+1), true},
+	} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/records", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header != "" {
+			req.Header.Set(requestIdHeader, test.header)
+		}
+		handler.ServeHTTP(rr, req)
+
+		requestId := rr.Header().Get(requestIdHeader)
+		if len(seen) != 1 || seen[0] != requestId {
+			t.Errorf("RequestId: handler got %v, response has %s", seen, requestId)
+		}
+		if test.generated == (requestId == test.header) || requestId == "" {
+			t.Errorf("RequestId: header %.10s: got ID %s", test.header, requestId)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+
+	domainFilter := common.CreateDomainFilter("", "", []string{"foo.bar", "foo.baz"}, nil)
+	provider := provider.NewMockProvider(&config.Config{}, domainFilter)
+	hook, err := NewWebhook(provider)
+	if err != nil {
+		t.Fatalf("Failure creating webHook: %s", err)
+	}
+
+	r := chi.NewRouter()
+	r.Get("/export", hook.Export)
+
+	for _, test := range []struct {
+		query       string
+		status      int
+		contentType string
+		contains    string
+	}{
+		{"", http.StatusOK, "text/plain", "$ORIGIN foo.baz.\n"},
+		{"?zone=foo.bar&format=bind", http.StatusOK, "text/plain", "a.foo.bar.\t0\tIN\tA\t1.1.1.1\n"},
+		{"?zone=foo.bar&format=json", http.StatusOK, "application/json", `"dnsName": "z.foo.bar"`},
+		{"?format=csv", http.StatusOK, "text/csv", "foo.baz,foo.baz,NS,172800,ns1.he.net,1011,true\n"},
+		{"?format=xml", http.StatusBadRequest, "", ""},
+		{"?zone=foo.zzz", http.StatusNotFound, "", ""},
+	} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/export"+test.query, nil)
+		r.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("/export%s: got status %d, wanted %d", test.query, rr.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if rr.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("/export%s: got content type %s, wanted %s", test.query, rr.Header().Get("Content-Type"), test.contentType)
+		}
+		if !strings.Contains(rr.Body.String(), test.contains) {
+			t.Errorf("/export%s: expected %q in\n%s", test.query, test.contains, rr.Body.String())
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+
+	domainFilter := common.CreateDomainFilter("", "", []string{"foo.bar"}, nil)
+	hook, err := NewWebhook(provider.NewMockProvider(&config.Config{}, domainFilter))
+	if err != nil {
+		t.Fatalf("Failure creating webHook: %s", err)
+	}
+
+	for _, test := range []struct {
+		token  string
+		header string
+		status int
+	}{
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+		// no token configured, eg on localhost
+		{"", "", http.StatusOK},
+	} {
+		r := chi.NewRouter()
+		r.Use(AdminAuth(test.token))
+		r.Get("/status", hook.Status("test"))
+
+		req, err := http.NewRequest("GET", "/status", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("/status with token '%s' and header '%s': got status %d, wanted %d", test.token, test.header, rr.Code, test.status)
+		}
+		if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("/status: missing WWW-Authenticate header")
+		}
+	}
+}
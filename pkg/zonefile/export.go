@@ -0,0 +1,205 @@
+package zonefile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+const (
+	FormatBind = "bind"
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// the longest character-string in a TXT record (RFC 1035 3.3)
+const maxCharacterString = 255
+
+// whether the format is one Export supports
+func IsFormat(format string) bool {
+	return format == FormatBind || format == FormatJSON || format == FormatCSV
+}
+
+// return the content type of the format, for HTTP responses
+func ContentType(format string) string {
+	switch format {
+	case FormatJSON:
+		return "application/json"
+	case FormatCSV:
+		return "text/csv"
+	}
+	return "text/plain"
+}
+
+// write the records of the zones in the given format: BIND writes one master
+// file section per zone, JSON a single list of endpoints like the webhook
+// returns them, CSV one row per target. Zones are written in name order
+func Export(w io.Writer, format string, zones map[string][]*endpoint.Endpoint) error {
+
+	names := []string{}
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+
+	switch format {
+	case FormatBind:
+		for i, zone := range names {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			if err := writeBind(w, zone, zones[zone]); err != nil {
+				return fmt.Errorf("Export: %s", err)
+			}
+		}
+	case FormatJSON:
+		endpoints := []*endpoint.Endpoint{}
+		for _, zone := range names {
+			endpoints = append(endpoints, zones[zone]...)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(endpoints); err != nil {
+			return fmt.Errorf("Export: %s", err)
+		}
+	case FormatCSV:
+		if err := writeCsv(w, names, zones); err != nil {
+			return fmt.Errorf("Export: %s", err)
+		}
+	default:
+		return fmt.Errorf("Export: %w: '%s'", ErrUnknownFormat, format)
+	}
+	return nil
+}
+
+// write the zone as an RFC 1035 master file, with fully qualified names
+func writeBind(w io.Writer, zone string, endpoints []*endpoint.Endpoint) error {
+
+	if _, err := fmt.Fprintf(w, "$ORIGIN %s\n", fqdn(zone)); err != nil {
+		return err
+	}
+	for _, record := range common.ExpandRecords(endpoints) {
+		line := fmt.Sprintf("%s\t%d\tIN\t%s\t%s", fqdn(record.DNSName), record.RecordTTL, record.RecordType, bindData(record.RecordType, record.Targets[0]))
+		// HE-specific, BIND wouldn't load it
+		if record.RecordType == "ALIAS" {
+			line = "; " + line
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// return the record data in master file syntax
+func bindData(recordType string, target string) string {
+
+	fields := strings.Fields(target)
+	switch recordType {
+	case "CNAME", "NS", "PTR", "ALIAS":
+		return fqdn(target)
+	case "MX":
+		// preference exchange
+		if len(fields) == 2 {
+			return fields[0] + " " + fqdn(fields[1])
+		}
+	case "SRV":
+		// priority weight port target
+		if len(fields) == 4 {
+			return strings.Join(fields[:3], " ") + " " + fqdn(fields[3])
+		}
+	case "TXT", "SPF":
+		return QuoteTxt(target)
+	}
+	return target
+}
+
+// return the TXT data as quoted character-strings, splitting those longer
+// than the maximum length. The data may already be quoted (HE returns it
+// that way), in which case the strings it's made of are kept
+func QuoteTxt(data string) string {
+
+	quoted := []string{}
+	for _, s := range splitTxt(data) {
+		for {
+			chunk := s
+			if len(chunk) > maxCharacterString {
+				chunk = chunk[:maxCharacterString]
+			}
+			s = s[len(chunk):]
+			quoted = append(quoted, `"`+strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(chunk)+`"`)
+			if s == "" {
+				break
+			}
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// return the unescaped character-strings of the TXT data: if it starts
+// with a quote, the quoted strings in it, otherwise the data as it is
+func splitTxt(data string) []string {
+
+	data = strings.TrimSpace(data)
+	if !strings.HasPrefix(data, `"`) {
+		return []string{data}
+	}
+
+	strs := []string{}
+	var current strings.Builder
+	inQuotes, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			if inQuotes {
+				strs = append(strs, current.String())
+				current.Reset()
+			}
+			inQuotes = !inQuotes
+		case inQuotes:
+			current.WriteRune(c)
+		}
+	}
+	// an unterminated string is kept as well
+	if inQuotes {
+		strs = append(strs, current.String())
+	}
+	return strs
+}
+
+func writeCsv(w io.Writer, names []string, zones map[string][]*endpoint.Endpoint) error {
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"zone", "name", "type", "ttl", "target", "record_id", "read_only"})
+	for _, zone := range names {
+		for _, record := range common.ExpandRecords(zones[zone]) {
+			recordId, _ := record.GetProviderSpecificProperty(common.RecordIdTag)
+			writer.Write([]string{zone, record.DNSName, record.RecordType, strconv.FormatInt(int64(record.RecordTTL), 10),
+				record.Targets[0], recordId, strconv.FormatBool(common.IsReadOnly(record))})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,103 @@
+package zonefile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/waldner/external-dns-webhook-he/pkg/common"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+var testZones = map[string][]*endpoint.Endpoint{
+	"foo.bar": {
+		endpoint.NewEndpointWithTTL("foo.bar", "NS", 172800, "ns1.he.net").WithProviderSpecific(common.ReadOnlyTag, "true"),
+		endpoint.NewEndpointWithTTL("foo.bar", "MX", 3600, "10 mail.foo.bar", "20 mail2.foo.bar"),
+		endpoint.NewEndpointWithTTL("_sip._tcp.foo.bar", "SRV", 300, "5 0 5060 sip.foo.bar"),
+		endpoint.NewEndpointWithTTL("foo.bar", "TXT", 300, `"v=spf1 include:\"x\" -all"`),
+		endpoint.NewEndpointWithTTL("www.foo.bar", "CNAME", 300, "foo.bar"),
+		endpoint.NewEndpointWithTTL("alias.foo.bar", "ALIAS", 300, "foo.bar"),
+	},
+	"foo.baz": {
+		endpoint.NewEndpointWithTTL("a.foo.baz", "A", 300, "1.1.1.1").WithProviderSpecific(common.RecordIdTag, "1001"),
+		endpoint.NewEndpointWithTTL("t.foo.baz", "TXT", 300, "plain, \"text\""),
+	},
+}
+
+func TestExportBind(t *testing.T) {
+
+	var buf bytes.Buffer
+	if err := Export(&buf, FormatBind, testZones); err != nil {
+		t.Fatalf("Export should not have failed, but got: %s", err)
+	}
+
+	expected := `$ORIGIN foo.bar.
+foo.bar.	172800	IN	NS	ns1.he.net.
+foo.bar.	3600	IN	MX	10 mail.foo.bar.
+foo.bar.	3600	IN	MX	20 mail2.foo.bar.
+_sip._tcp.foo.bar.	300	IN	SRV	5 0 5060 sip.foo.bar.
+foo.bar.	300	IN	TXT	"v=spf1 include:\"x\" -all"
+www.foo.bar.	300	IN	CNAME	foo.bar.
+; alias.foo.bar.	300	IN	ALIAS	foo.bar.
+
+$ORIGIN foo.baz.
+a.foo.baz.	300	IN	A	1.1.1.1
+t.foo.baz.	300	IN	TXT	"plain, \"text\""
+`
+	if buf.String() != expected {
+		t.Errorf("Export: got\n%s\nwanted\n%s", buf.String(), expected)
+	}
+}
+
+func TestQuoteTxt(t *testing.T) {
+
+	long := strings.Repeat("a", 300)
+	for _, test := range []struct {
+		data     string
+		expected string
+	}{
+		{"hello world", `"hello world"`},
+		{`"already" "quoted"`, `"already" "quoted"`},
+		{`back\slash`, `"back\\slash"`},
+		{"", `""`},
+		{long, `"` + long[:255] + `" "` + long[255:] + `"`},
+	} {
+		if got := QuoteTxt(test.data); got != test.expected {
+			t.Errorf("QuoteTxt(%s): got %s, wanted %s", test.data, got, test.expected)
+		}
+	}
+}
+
+func TestExportJSONAndCSV(t *testing.T) {
+
+	var buf bytes.Buffer
+	if err := Export(&buf, FormatJSON, testZones); err != nil {
+		t.Fatalf("Export should not have failed, but got: %s", err)
+	}
+	endpoints := []*endpoint.Endpoint{}
+	if err := json.Unmarshal(buf.Bytes(), &endpoints); err != nil {
+		t.Fatalf("Export: invalid JSON: %s", err)
+	}
+	if len(endpoints) != 8 || endpoints[6].DNSName != "a.foo.baz" {
+		t.Errorf("Export: got %v, wanted the endpoints of both zones in order", endpoints)
+	}
+
+	buf.Reset()
+	if err := Export(&buf, FormatCSV, testZones); err != nil {
+		t.Fatalf("Export should not have failed, but got: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	// header and one line per target
+	if len(lines) != 10 {
+		t.Fatalf("Export: got %d CSV lines, wanted 10", len(lines))
+	}
+	if lines[8] != "foo.baz,a.foo.baz,A,300,1.1.1.1,1001,false" || lines[9] != `foo.baz,t.foo.baz,TXT,300,"plain, ""text""",,false` {
+		t.Errorf("Export: unexpected CSV rows:\n%s\n%s", lines[8], lines[9])
+	}
+
+	if err := Export(&buf, "xml", testZones); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Export: expected an unknown format error, got %v", err)
+	}
+}
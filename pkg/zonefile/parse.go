@@ -0,0 +1,330 @@
+package zonefile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// a word of the master file. Quoted strings are unescaped
+type token struct {
+	text   string
+	quoted bool
+}
+
+// an entry of the master file, which may span several lines with parentheses
+type entry struct {
+	line int
+	// the entry starts with a blank, so it has the owner of the previous one
+	sameOwner bool
+	tokens    []token
+}
+
+// parse an RFC 1035 master file, with origin as the initial $ORIGIN, and return
+// one single-target endpoint per resource record, in file order. Names are fully
+// qualified (without the final dot), and the host names in the data of CNAME,
+// NS, PTR, MX and SRV records are too. TXT and SPF data is returned as quoted
+// strings, which is how HE returns it. Only the IN class is supported
+func Parse(r io.Reader, origin string) ([]*endpoint.Endpoint, error) {
+
+	entries, err := readEntries(r)
+	if err != nil {
+		return nil, fmt.Errorf("Parse: %s", err)
+	}
+
+	origin = strings.TrimSuffix(strings.ToLower(origin), ".")
+	var ttl endpoint.TTL
+	owner := ""
+	endpoints := []*endpoint.Endpoint{}
+
+	for _, e := range entries {
+		tokens := e.tokens
+
+		if !e.sameOwner && strings.HasPrefix(tokens[0].text, "$") && !tokens[0].quoted {
+			directive := strings.ToUpper(tokens[0].text)
+			switch {
+			case directive == "$ORIGIN" && len(tokens) == 2:
+				origin = absoluteName(tokens[1].text, origin)
+			case directive == "$TTL" && len(tokens) == 2:
+				value, err := parseTtl(tokens[1].text)
+				if err != nil {
+					return nil, fmt.Errorf("Parse: line %d: %s", e.line, err)
+				}
+				ttl = value
+			default:
+				return nil, fmt.Errorf("Parse: line %d: unsupported directive '%s'", e.line, tokens[0].text)
+			}
+			continue
+		}
+
+		if !e.sameOwner {
+			owner = absoluteName(tokens[0].text, origin)
+			tokens = tokens[1:]
+		}
+		if owner == "" {
+			return nil, fmt.Errorf("Parse: line %d: record without a name", e.line)
+		}
+
+		// TTL and class can come in either order, and are both optional
+		recordTtl := ttl
+		class := "IN"
+		for i := 0; i < 2 && len(tokens) > 0; i++ {
+			if value, err := parseTtl(tokens[0].text); err == nil {
+				recordTtl = value
+				tokens = tokens[1:]
+			} else if isClass(tokens[0].text) {
+				class = strings.ToUpper(tokens[0].text)
+				tokens = tokens[1:]
+			}
+		}
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("Parse: line %d: missing record type or data", e.line)
+		}
+		if class != "IN" {
+			return nil, fmt.Errorf("Parse: line %d: unsupported class %s", e.line, class)
+		}
+
+		recordType := strings.ToUpper(tokens[0].text)
+		if tokens[0].quoted || !isRecordType(recordType) {
+			return nil, fmt.Errorf("Parse: line %d: invalid record type or TTL '%s'", e.line, tokens[0].text)
+		}
+		target, err := recordData(recordType, tokens[1:], origin)
+		if err != nil {
+			return nil, fmt.Errorf("Parse: line %d: %s", e.line, err)
+		}
+		endpoints = append(endpoints, endpoint.NewEndpointWithTTL(owner, recordType, recordTtl, target))
+		// without $TTL, a record without TTL gets the one of the previous record
+		ttl = recordTtl
+	}
+	return endpoints, nil
+}
+
+// return the record data in the form external-dns and HE use
+func recordData(recordType string, tokens []token, origin string) (string, error) {
+
+	texts := []string{}
+	for _, t := range tokens {
+		texts = append(texts, t.text)
+	}
+
+	switch recordType {
+	case "CNAME", "NS", "PTR", "ALIAS":
+		if len(tokens) != 1 {
+			return "", fmt.Errorf("%s record must have a single host name", recordType)
+		}
+		return absoluteName(texts[0], origin), nil
+	case "MX":
+		if len(tokens) != 2 {
+			return "", fmt.Errorf("MX record must have a preference and a host name")
+		}
+		return texts[0] + " " + absoluteName(texts[1], origin), nil
+	case "SRV":
+		if len(tokens) != 4 {
+			return "", fmt.Errorf("SRV record must have priority, weight, port and target")
+		}
+		return strings.Join(texts[:3], " ") + " " + absoluteName(texts[3], origin), nil
+	case "TXT", "SPF":
+		return QuoteTxt(quoteTokens(tokens)), nil
+	}
+	return quoteTokens(tokens), nil
+}
+
+// join the tokens, quoting again those that were quoted
+func quoteTokens(tokens []token) string {
+	texts := []string{}
+	for _, t := range tokens {
+		if t.quoted {
+			texts = append(texts, `"`+strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(t.text)+`"`)
+			continue
+		}
+		texts = append(texts, t.text)
+	}
+	return strings.Join(texts, " ")
+}
+
+// return the name fully qualified, without the final dot
+func absoluteName(name string, origin string) string {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	}
+	return name + "." + origin
+}
+
+func isRecordType(s string) bool {
+	for i, c := range s {
+		if !(c >= 'A' && c <= 'Z') && (i == 0 || !(c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isClass(s string) bool {
+	switch strings.ToUpper(s) {
+	case "IN", "CH", "HS", "CS":
+		return true
+	}
+	return false
+}
+
+// parse a TTL in seconds, or in the BIND form with units (eg 1h30m)
+func parseTtl(s string) (endpoint.TTL, error) {
+
+	if seconds, err := strconv.ParseUint(s, 10, 31); err == nil {
+		return endpoint.TTL(seconds), nil
+	}
+
+	units := map[rune]int64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total, current int64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		switch {
+		case unicode.IsDigit(c):
+			current = current*10 + int64(c-'0')
+			digits = true
+		case units[c] > 0 && digits:
+			total += current * units[c]
+			current, digits = 0, false
+		default:
+			return 0, fmt.Errorf("invalid TTL '%s'", s)
+		}
+		if total+current > 1<<31-1 {
+			return 0, fmt.Errorf("invalid TTL '%s'", s)
+		}
+	}
+	if s == "" || digits {
+		return 0, fmt.Errorf("invalid TTL '%s'", s)
+	}
+	return endpoint.TTL(total), nil
+}
+
+// split the master file into entries: comments are removed, entries
+// continue across lines inside parentheses, quoted strings are kept whole
+func readEntries(r io.Reader) ([]*entry, error) {
+
+	reader := bufio.NewReader(r)
+	entries := []*entry{}
+
+	line := 1
+	depth := 0
+	var current *entry
+	var word strings.Builder
+	inWord, inQuotes, escaped, inComment := false, false, false, false
+	atLineStart := true
+
+	endWord := func(quoted bool) {
+		if inWord || quoted {
+			current.tokens = append(current.tokens, token{text: word.String(), quoted: quoted})
+		}
+		word.Reset()
+		inWord = false
+	}
+	startEntry := func(sameOwner bool) {
+		if current == nil {
+			current = &entry{line: line, sameOwner: sameOwner}
+		}
+	}
+	endEntry := func() {
+		if current != nil && len(current.tokens) > 0 {
+			entries = append(entries, current)
+		}
+		current = nil
+	}
+
+	for {
+		c, _, err := reader.ReadRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("readEntries: %s", err)
+		}
+
+		switch {
+		case inComment:
+			if c == '\n' {
+				inComment = false
+				reader.UnreadRune()
+			}
+		case inQuotes:
+			switch {
+			case escaped:
+				word.WriteRune(c)
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				endWord(true)
+				inQuotes = false
+			default:
+				if c == '\n' {
+					line++
+				}
+				word.WriteRune(c)
+			}
+		case c == '\n':
+			endWord(false)
+			if depth == 0 {
+				endEntry()
+			}
+			line++
+			atLineStart = true
+			continue
+		case c == ';':
+			endWord(false)
+			inComment = true
+		case c == ' ' || c == '\t' || c == '\r':
+			if atLineStart && depth == 0 && c != '\r' {
+				startEntry(true)
+			}
+			endWord(false)
+		case c == '(':
+			startEntry(false)
+			endWord(false)
+			depth++
+		case c == ')':
+			endWord(false)
+			if depth == 0 {
+				return nil, fmt.Errorf("readEntries: line %d: unbalanced parentheses", line)
+			}
+			depth--
+		case c == '"':
+			startEntry(false)
+			endWord(false)
+			inQuotes = true
+		default:
+			startEntry(false)
+			if c == '\\' {
+				// keep escapes outside quotes as they are, eg in names
+				word.WriteRune(c)
+				if next, _, err := reader.ReadRune(); err == nil {
+					c = next
+				}
+			}
+			word.WriteRune(c)
+			inWord = true
+		}
+		atLineStart = false
+	}
+
+	if inQuotes {
+		return nil, fmt.Errorf("readEntries: line %d: unterminated quoted string", line)
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("readEntries: line %d: unbalanced parentheses", line)
+	}
+	endWord(false)
+	endEntry()
+	return entries, nil
+}
@@ -0,0 +1,109 @@
+package zonefile
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testZoneFile = `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1.example.com. hostmaster.example.com. (
+		2024010101 ; serial
+		7200 3600 1209600 3600 )
+	IN	NS	ns1.example.com.
+	IN	MX	10 mail
+www	300	IN	A	192.0.2.1
+	IN 300	A	192.0.2.2  ; same owner, class before TTL
+mail		A	192.0.2.3
+alias		CNAME	www
+txt		TXT	"v=spf1 include:\"x\" -all" "second; string"
+long		TXT	( "part one"
+			  "part two" )
+_sip._tcp	SRV	5 0 5060 sip.example.net.
+caa		CAA	0 issue "letsencrypt.org"
+$ORIGIN sub.example.com.
+host	1d	A	192.0.2.4
+`
+
+func TestParse(t *testing.T) {
+
+	endpoints, err := Parse(strings.NewReader(testZoneFile), "example.com")
+	if err != nil {
+		t.Fatalf("Parse should not have failed, but got: %s", err)
+	}
+
+	expected := []string{
+		"example.com 3600 SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 3600",
+		"example.com 3600 NS ns1.example.com",
+		"example.com 3600 MX 10 mail.example.com",
+		"www.example.com 300 A 192.0.2.1",
+		"www.example.com 300 A 192.0.2.2",
+		"mail.example.com 300 A 192.0.2.3",
+		"alias.example.com 300 CNAME www.example.com",
+		`txt.example.com 300 TXT "v=spf1 include:\"x\" -all" "second; string"`,
+		`long.example.com 300 TXT "part one" "part two"`,
+		"_sip._tcp.example.com 300 SRV 5 0 5060 sip.example.net",
+		`caa.example.com 300 CAA 0 issue "letsencrypt.org"`,
+		"host.sub.example.com 86400 A 192.0.2.4",
+	}
+	if len(endpoints) != len(expected) {
+		t.Fatalf("Parse: got %d records, wanted %d: %v", len(endpoints), len(expected), endpoints)
+	}
+	for i, ep := range endpoints {
+		got := strings.Join([]string{ep.DNSName, fmt.Sprint(ep.RecordTTL), ep.RecordType, ep.Targets[0]}, " ")
+		if got != expected[i] {
+			t.Errorf("Parse: got '%s', wanted '%s'", got, expected[i])
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+
+	for _, data := range []string{
+		"$INCLUDE other.zone\n",
+		"www IN A\n",
+		"www CH TXT \"x\"\n",
+		"www IN TXT \"unterminated\n",
+		"www IN TXT ( \"x\"\n",
+		"www 1x A 1.2.3.4\n",
+		"www IN MX mail\n",
+	} {
+		if _, err := Parse(strings.NewReader(data), "example.com"); err == nil {
+			t.Errorf("Parse should have failed for %q", data)
+		}
+	}
+}
+
+// what Export writes, Parse reads back
+func TestExportParse(t *testing.T) {
+
+	var buf bytes.Buffer
+	if err := Export(&buf, FormatBind, testZones); err != nil {
+		t.Fatalf("Export should not have failed, but got: %s", err)
+	}
+	endpoints, err := Parse(&buf, "")
+	if err != nil {
+		t.Fatalf("Parse should not have failed, but got: %s", err)
+	}
+
+	i := 0
+	for _, zone := range []string{"foo.bar", "foo.baz"} {
+		for _, ep := range testZones[zone] {
+			if ep.RecordType == "ALIAS" {
+				continue
+			}
+			for _, target := range ep.Targets {
+				got := endpoints[i]
+				if got.DNSName != ep.DNSName || got.RecordType != ep.RecordType || got.RecordTTL != ep.RecordTTL || (got.Targets[0] != target && ep.RecordType != "TXT") {
+					t.Errorf("Parse: got %s, wanted %s %s", got, ep, target)
+				}
+				i++
+			}
+		}
+	}
+	if i != len(endpoints) {
+		t.Errorf("Parse: got %d records, wanted %d", len(endpoints), i)
+	}
+}